@@ -0,0 +1,95 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/vvidic/mjpeg-proxy/mjpegproxy"
+)
+
+// Frames read and the time allowed for them by -check.
+const (
+	checkFrames  = 10
+	checkTimeout = 30 * time.Second
+)
+
+// checkSources connects to each of the streams in turn, reads a few
+// frames and prints what was found, without starting the server. It
+// stops at the first stream that fails.
+func checkSources(streams []configSource) error {
+	for _, conf := range streams {
+		if conf.Enabled != nil && !*conf.Enabled {
+			continue
+		}
+		if err := checkSource(conf); err != nil {
+			return fmt.Errorf("%s: %w", conf.id(), err)
+		}
+	}
+	return nil
+}
+
+func checkSource(conf configSource) error {
+	chunker, err := newChunker(conf.id(), conf.Source, conf, conf.Fallbacks...)
+	if err != nil {
+		return err
+	}
+	chunker.MaxRetries = 0 // report the first failure
+
+	err = chunker.Connect()
+	if err != nil {
+		return err
+	}
+
+	boundary := ""
+	if resp := chunker.LastResponse(); resp != nil {
+		boundary = resp.Boundary
+	}
+	fmt.Fprintf(os.Stdout, "%s: connected to %s, boundary %q\n",
+		conf.id(), chunker.Source(), boundary)
+
+	pubChan := make(chan mjpegproxy.Frame)
+	go chunker.Start(pubChan)
+	defer chunker.Stop()
+
+	var first time.Time
+	timeout := time.After(checkTimeout)
+	for n := 1; n <= checkFrames; n++ {
+		select {
+		case frame, ok := <-pubChan:
+			if !ok {
+				return fmt.Errorf("stream ended after %d frames", n-1)
+			}
+			if n == 1 {
+				first = time.Now()
+			}
+			fmt.Fprintf(os.Stdout, "%s: frame %d, %d bytes, %s\n",
+				conf.id(), n, len(frame.Data), chunker.ContentType())
+		case <-timeout:
+			return fmt.Errorf("got %d frames in %s", n-1, checkTimeout)
+		}
+	}
+
+	fmt.Fprintf(os.Stdout, "%s: ok, %.1f fps\n",
+		conf.id(), float64(checkFrames-1)/time.Since(first).Seconds())
+	return nil
+}
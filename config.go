@@ -0,0 +1,284 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+/* Sample configuration file:
+
+   {
+      "Streams" : [
+         {
+            "Name" : "front-door",
+            "Source" : "http://192.168.1.10/mjpg",
+            "Path" : "/cam1"
+         }
+      ]
+   }
+
+   A plain list of streams without the "Streams" key is accepted too.
+   Client access tokens can be listed under "Tokens".
+*/
+
+type Config struct {
+	Streams []configSource
+	Tokens  []string
+}
+
+type configSource struct {
+	Name      string
+	Source    string
+	Username  string
+	Password  string
+	Digest    bool
+	Headers   map[string]string
+	Path      string
+	Rate      float64
+	Enabled   *bool
+	Standby   string
+	Fallbacks []string
+	Eager     bool
+}
+
+// id returns the name used for the stream in logs and metrics.
+func (conf configSource) id() string {
+	if conf.Name != "" {
+		return conf.Name
+	}
+	return conf.Path
+}
+
+// LoadConfig reads the stream configuration from a JSON file. The file
+// name doesn't matter, the content is decoded as JSON. JSON is valid
+// YAML too, so a .yaml file written as JSON loads as well, but for one
+// in the YAML syntax the error says so instead of only showing the JSON
+// syntax error.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := new(Config)
+	data = bytes.TrimSpace(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields() // catch misspelled options
+	if len(data) > 0 && data[0] == '[' {
+		err = dec.Decode(&config.Streams)
+	} else {
+		err = dec.Decode(config)
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) && isYAMLFile(filename) {
+		return nil, fmt.Errorf("%s: %s: YAML syntax is not supported, write the configuration as JSON", filename, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return config, nil
+}
+
+func isYAMLFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func (config *Config) validate() error {
+	if len(config.Streams) == 0 {
+		return errors.New("no streams configured")
+	}
+
+	exists := make(map[string]bool)
+	names := make(map[string]bool)
+	used := make(map[string]string) // served path to its user, for the errors
+	for _, fixed := range fixedPaths() {
+		if owner, ok := used[fixed.path]; ok {
+			return fmt.Errorf("%s path %s already used by %s", fixed.owner, fixed.path, owner)
+		}
+		used[fixed.path] = fixed.owner
+	}
+
+	for i, conf := range config.Streams {
+		if conf.Path == "" {
+			return fmt.Errorf("stream %d: path missing", i+1)
+		}
+		if !strings.HasPrefix(conf.Path, "/") {
+			return fmt.Errorf("stream %d: path must start with /: %s", i+1, conf.Path)
+		}
+		if conf.Source == "" {
+			return fmt.Errorf("stream %d: source missing", i+1)
+		}
+		for key := range conf.Headers {
+			if strings.TrimSpace(key) == "" {
+				return fmt.Errorf("stream %d: empty header name", i+1)
+			}
+		}
+		if exists[conf.Path] {
+			return fmt.Errorf("duplicate proxy path: %s", conf.Path)
+		}
+		if conf.Name != "" && names[conf.Name] {
+			return fmt.Errorf("duplicate stream name: %s", conf.Name)
+		}
+
+		// http.ServeMux panics on a path registered twice, like the
+		// snapshot of /cam for a stream at /cam/snapshot
+		for _, path := range conf.servedPaths() {
+			if owner, ok := used[path]; ok {
+				return fmt.Errorf("stream %d: path %s already used by %s", i+1, path, owner)
+			}
+			used[path] = fmt.Sprintf("stream %d", i+1)
+		}
+
+		exists[conf.Path] = true
+		names[conf.Name] = true
+	}
+
+	return nil
+}
+
+type fixedPath struct {
+	path, owner string
+}
+
+// fixedPaths returns the endpoints main serves besides the streams, the
+// ones that are enabled.
+func fixedPaths() []fixedPath {
+	paths := []fixedPath{
+		{"/healthz", "the health check"},
+		{"/readyz", "the readiness check"},
+		{"/admin/restart", "the admin endpoint"},
+		{"/debug/source", "the admin endpoint"},
+	}
+	for _, fixed := range []fixedPath{
+		{metricsPath, "the -metrics endpoint"},
+		{statusPath, "the -status endpoint"},
+		{viewerPath, "the -viewer page"},
+	} {
+		if fixed.path != "" {
+			paths = append(paths, fixed)
+		}
+	}
+	return paths
+}
+
+// servedPaths returns the paths startSource registers for the stream:
+// its own and the endpoints below it. A disabled stream only has its own.
+func (conf configSource) servedPaths() []string {
+	if conf.Enabled != nil && !*conf.Enabled {
+		return []string{conf.Path}
+	}
+
+	paths := []string{conf.Path,
+		subPath(conf.Path, "snapshot"), subPath(conf.Path, "ws"), subPath(conf.Path, "events")}
+	if thumbWidth > 0 {
+		paths = append(paths, subPath(conf.Path, "thumb"))
+	}
+	return paths
+}
+
+// stringList collects the values of a flag given multiple times.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ", ")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// parseHeaders converts the repeated "Key: Value" -header and -set-header
+// flags into a map of headers.
+func parseHeaders(list stringList) (map[string]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	headers := make(map[string]string)
+	for _, header := range list {
+		kv := strings.SplitN(header, ":", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || key == "" {
+			return nil, fmt.Errorf("invalid header, expected Key: Value: %s", header)
+		}
+		headers[key] = strings.TrimSpace(kv[1])
+	}
+
+	return headers, nil
+}
+
+// flagSources pairs the repeated -source, -path and -name flags into
+// stream configurations. A single source defaults to the root path.
+func flagSources(sources, paths, names stringList, base configSource) (*Config, error) {
+	if len(sources) == 0 {
+		sources = stringList{"http://example.com/img.mjpg"}
+	}
+	if len(paths) == 0 && len(sources) == 1 {
+		paths = stringList{"/"}
+	}
+	if len(paths) != len(sources) {
+		return nil, fmt.Errorf("got %d sources for %d paths", len(sources), len(paths))
+	}
+	if len(names) > 0 && len(names) != len(sources) {
+		return nil, fmt.Errorf("got %d sources for %d names", len(sources), len(names))
+	}
+	if base.Standby != "" && len(sources) > 1 {
+		return nil, errors.New("standby source needs a single source")
+	}
+	if len(base.Fallbacks) > 0 && len(sources) > 1 {
+		return nil, errors.New("fallback sources need a single source")
+	}
+
+	config := new(Config)
+	for i := range sources {
+		conf := base
+		conf.Source = sources[i]
+		conf.Path = paths[i]
+		if len(names) > 0 {
+			conf.Name = names[i]
+		}
+		config.Streams = append(config.Streams, conf)
+	}
+
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
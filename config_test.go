@@ -0,0 +1,156 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(filename, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	const streams = `[{"Source": "http://camera/mjpg", "Path": "/cam"}]`
+	const yaml = "- Source: http://camera/mjpg\n  Path: /cam\n"
+
+	tests := []struct {
+		name, data string
+		err        string // part of the error, "" to load
+	}{
+		{"sources.json", streams, ""},
+		{"sources", streams, ""},
+		{"sources.conf", streams, ""},
+		{"sources.yaml", streams, ""},
+		{"sources.yml", yaml, "YAML syntax is not supported"},
+		{"sources.conf", yaml, "invalid character"},
+		{"sources.json", `{"Streams": []}`, "no streams configured"},
+	}
+
+	for _, tt := range tests {
+		config, err := LoadConfig(writeConfig(t, tt.name, tt.data))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: LoadConfig: %s", tt.name, err)
+			} else if len(config.Streams) != 1 || config.Streams[0].Path != "/cam" {
+				t.Errorf("%s: streams = %+v", tt.name, config.Streams)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: LoadConfig error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidatePaths(t *testing.T) {
+	defer func(width int) { thumbWidth = width }(thumbWidth)
+	disabled := false
+
+	tests := []struct {
+		name    string
+		streams []configSource
+		thumbs  bool
+		err     string // part of the error, "" when valid
+	}{
+		{"separate", []configSource{{Path: "/cam1"}, {Path: "/cam2"}}, true, ""},
+		{"duplicate", []configSource{{Path: "/cam"}, {Path: "/cam"}}, false, "duplicate proxy path"},
+		{"snapshot", []configSource{{Path: "/cam"}, {Path: "/cam/snapshot"}}, false, "/cam/snapshot already used by stream 1"},
+		{"snapshot first", []configSource{{Path: "/cam/ws"}, {Path: "/cam/"}}, false, "/cam/ws already used by stream 1"},
+		{"events", []configSource{{Path: "/cam/events"}, {Path: "/cam"}}, false, "already used"},
+		{"thumb", []configSource{{Path: "/cam"}, {Path: "/cam/thumb"}}, true, "/cam/thumb already used"},
+		{"no thumbs", []configSource{{Path: "/cam"}, {Path: "/cam/thumb"}}, false, ""},
+		{"disabled", []configSource{{Path: "/cam/snapshot", Enabled: &disabled}, {Path: "/cam", Enabled: &disabled}}, false, ""},
+	}
+
+	for _, tt := range tests {
+		thumbWidth = 0
+		if tt.thumbs {
+			thumbWidth = 160
+		}
+		config := &Config{Streams: tt.streams}
+		for i := range config.Streams {
+			config.Streams[i].Source = "http://camera/mjpg"
+		}
+
+		err := config.validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: validate: %s", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validate error = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestValidateFixedPaths(t *testing.T) {
+	defer func(metrics, status, viewer string) {
+		metricsPath, statusPath, viewerPath = metrics, status, viewer
+	}(metricsPath, statusPath, viewerPath)
+	metricsPath, statusPath, viewerPath = "/metrics", "/status", "/view"
+
+	tests := []struct {
+		path string
+		err  string // part of the error, "" when valid
+	}{
+		{"/cam", ""},
+		{"/metrics", "path /metrics already used by the -metrics endpoint"},
+		{"/status", "the -status endpoint"},
+		{"/view", "the -viewer page"},
+		{"/healthz", "path /healthz already used by the health check"},
+		{"/readyz", "the readiness check"},
+		{"/admin/restart", "the admin endpoint"},
+		{"/debug/source", "the admin endpoint"},
+	}
+
+	for _, tt := range tests {
+		config := &Config{Streams: []configSource{{Source: "http://camera/mjpg", Path: tt.path}}}
+		err := config.validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: validate: %s", tt.path, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: validate error = %v, want %q", tt.path, err, tt.err)
+		}
+	}
+
+	// the endpoints clash among themselves too
+	statusPath = "/metrics"
+	config := &Config{Streams: []configSource{{Source: "http://camera/mjpg", Path: "/cam"}}}
+	if err := config.validate(); err == nil || !strings.Contains(err.Error(), "-status endpoint path /metrics") {
+		t.Errorf("status at the metrics path: validate error = %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/vvidic/mjpeg-proxy/mjpegproxy"
+)
+
+// outputFPSCap limits the frame rate published by every stream. It holds
+// the bits of a float64 and zero means no limit.
+var outputFPSCap uint64
+
+func getOutputFPSCap() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&outputFPSCap))
+}
+
+func setOutputFPSCap(fps float64) {
+	atomic.StoreUint64(&outputFPSCap, math.Float64bits(fps))
+}
+
+// CPUThrottle lowers the output frame rate of all the streams while the
+// process uses more than the high share of the available CPUs, and
+// raises it again once the usage drops below the low share.
+type CPUThrottle struct {
+	high       float64
+	low        float64
+	minFPS     float64
+	interval   time.Duration
+	pubSubs    []*mjpegproxy.PubSub
+	lastCPU    time.Duration
+	lastTime   time.Time
+	lastFrames map[*mjpegproxy.PubSub]int64
+}
+
+func NewCPUThrottle(high, low, minFPS float64, interval time.Duration, pubSubs []*mjpegproxy.PubSub) (*CPUThrottle, error) {
+	if low <= 0 || low >= high {
+		return nil, fmt.Errorf("low threshold %.2f must be between 0 and %.2f", low, high)
+	}
+	if minFPS <= 0 {
+		return nil, fmt.Errorf("invalid minimum frame rate: %.2f", minFPS)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval: %s", interval)
+	}
+
+	cpu, err := processCPUTime()
+	if err != nil {
+		return nil, err
+	}
+
+	throttle := new(CPUThrottle)
+
+	throttle.high = high
+	throttle.low = low
+	throttle.minFPS = minFPS
+	throttle.interval = interval
+	throttle.pubSubs = pubSubs
+	throttle.lastCPU = cpu
+	throttle.lastTime = time.Now()
+	throttle.lastFrames = make(map[*mjpegproxy.PubSub]int64)
+
+	return throttle, nil
+}
+
+func (throttle *CPUThrottle) Start() {
+	logger.Info("throttling output", "component", "cpu", "high", throttle.high)
+	go throttle.loop()
+}
+
+func (throttle *CPUThrottle) loop() {
+	ticker := time.NewTicker(throttle.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		throttle.adjust()
+	}
+}
+
+// sourceFPS returns the highest incoming frame rate of all the streams.
+func (throttle *CPUThrottle) sourceFPS(elapsed time.Duration) float64 {
+	maxFPS := 0.0
+	for _, pubSub := range throttle.pubSubs {
+		stats := pubSub.Stats()
+		frames := stats.Frames + stats.Throttled
+		fps := float64(frames-throttle.lastFrames[pubSub]) / elapsed.Seconds()
+		throttle.lastFrames[pubSub] = frames
+		if fps > maxFPS {
+			maxFPS = fps
+		}
+	}
+	return maxFPS
+}
+
+func (throttle *CPUThrottle) adjust() {
+	cpu, err := processCPUTime()
+	if err != nil {
+		logger.Warn("usage failed", "component", "cpu", "err", err)
+		return
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(throttle.lastTime)
+	usage := float64(cpu-throttle.lastCPU) / float64(elapsed) / float64(runtime.GOMAXPROCS(0))
+	throttle.lastCPU = cpu
+	throttle.lastTime = now
+
+	sourceFPS := throttle.sourceFPS(elapsed)
+	current := getOutputFPSCap()
+	next := current
+
+	switch {
+	case usage > throttle.high:
+		if next == 0 {
+			next = sourceFPS
+		}
+		next /= 2
+		if next < throttle.minFPS {
+			next = throttle.minFPS
+		}
+	case usage < throttle.low && current > 0:
+		next *= 2
+		if next >= sourceFPS {
+			next = 0
+		}
+	}
+
+	if next == current || (current == 0 && sourceFPS == 0) {
+		return
+	}
+
+	setOutputFPSCap(next)
+	if next == 0 {
+		logger.Info("removing output frame rate limit", "component", "cpu", "usage", usage)
+	} else {
+		logger.Info("limiting output frame rate", "component", "cpu", "usage", usage, "fps", next)
+	}
+}
@@ -20,93 +20,264 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/vvidic/mjpeg-proxy/mjpegproxy"
 )
 
+// The settings of the streams, filled in from the flags. The options and
+// access checks are shared by all the streams.
 var (
-	clientHeader  string
-	frameTimeout  time.Duration
-	stopDelay     time.Duration
-	tcpSendBuffer int
+	options mjpegproxy.Options
+	access  = new(mjpegproxy.Access)
+
+	tcpSendBuffer     int
+	pooledRead        bool
+	backoffJitter     string
+	retryMax          int
+	maxRedirects      int
+	retryBase         time.Duration
+	retryCap          time.Duration
+	connectTimeout    time.Duration
+	frameTimeout      time.Duration
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	httpIdleTimeout   time.Duration
+	sourceInsecure    bool
+	sourceRootCAs     *x509.CertPool
+	thumbWidth        int
+	maxFrameSize      int64
+	maxHeaderSize     int
+	validateJPEG      bool
+	strictMultipart   bool
+	freezeFrames      int
+	freezeTime        time.Duration
+	freezeReconnect   bool
+	allowEmptyChunks  bool
+	readBuffer        int
+	recordFile        string
+	recordMaxSize     int64
+	viewerPath        string
+	statusPath        string
+	metricsPath       string
+
+	pubSubs []*mjpegproxy.PubSub
+	webhook *mjpegproxy.Webhook
+
+	// the public handlers, not http.DefaultServeMux where net/http/pprof
+	// adds its own
+	mux = http.NewServeMux()
 )
 
-type configSource struct {
-	Source   string
-	Username string
-	Password string
-	Digest   bool
-	Path     string
-	Rate     float64
-}
+// newChunker creates a chunker for one of the stream sources and applies
+// the settings shared by all the sources.
+func newChunker(id, source string, conf configSource, fallbacks ...string) (*mjpegproxy.Chunker, error) {
+	backoff, err := mjpegproxy.NewBackoff(retryBase, retryCap, backoffJitter)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := mjpegproxy.WithBasicAuth(conf.Username, conf.Password)
+	if conf.Digest {
+		auth = mjpegproxy.WithDigestAuth(conf.Username, conf.Password)
+	}
 
-func startSource(source, username, password, proxyUrl string, digest bool, rate float64) error {
-	chunker, err := NewChunker(proxyUrl, source, username, password, digest, rate)
+	chunker, err := mjpegproxy.NewSourceChunker(source,
+		mjpegproxy.WithName(id),
+		auth,
+		mjpegproxy.WithRate(conf.Rate),
+		mjpegproxy.WithHeaders(conf.Headers),
+		mjpegproxy.WithTimeout(connectTimeout),
+		mjpegproxy.WithMaxFrameSize(maxFrameSize),
+		mjpegproxy.WithRetries(retryMax, backoff),
+		mjpegproxy.WithFallbacks(fallbacks...),
+		mjpegproxy.WithTLS(sourceRootCAs, sourceInsecure))
 	if err != nil {
-		return fmt.Errorf("chunker[%s]: create failed: %s", proxyUrl, err)
+		return nil, err
 	}
-	pubSub := NewPubSub(proxyUrl, chunker)
-	pubSub.Start()
 
-	fmt.Printf("chunker[%s]: serving from %s\n", proxyUrl, source)
-	http.Handle(proxyUrl, pubSub)
+	chunker.ValidateJPEG = validateJPEG
+	chunker.StrictMultipart = strictMultipart
+	chunker.FreezeFrames = freezeFrames
+	chunker.FreezeTime = freezeTime
+	chunker.FreezeReconnect = freezeReconnect
+	chunker.AllowEmptyChunks = allowEmptyChunks
+	chunker.ReadBuffer = readBuffer
+	chunker.MaxHeaderSize = maxHeaderSize
+	chunker.PooledRead = pooledRead
+	chunker.FrameTimeout = frameTimeout
+	chunker.MaxRedirects = maxRedirects
 
-	return nil
+	return chunker, nil
 }
 
-func loadConfig(filename string) error {
-	file, err := os.Open(filename)
+func startSource(conf configSource) error {
+	id := conf.id()
+	chunker, err := newChunker(id, conf.Source, conf, conf.Fallbacks...)
 	if err != nil {
-		return err
+		return fmt.Errorf("chunker[%s]: create failed: %s", id, err)
 	}
-	defer func() {
-		err := file.Close()
+
+	var standby *mjpegproxy.Chunker
+	if conf.Standby != "" {
+		standby, err = newChunker(id+" standby", conf.Standby, conf)
 		if err != nil {
-			fmt.Printf("config: file close failed for %s: %s\n", file.Name(), err)
+			return fmt.Errorf("chunker[%s]: standby create failed: %s", id, err)
 		}
-	}()
+	}
 
-	sources := make([]configSource, 0)
-	dec := json.NewDecoder(file)
-	err = dec.Decode(&sources)
-	if err != nil && err != io.EOF {
-		return err
+	if webhook != nil {
+		webhook.Watch(chunker, conf.Path)
+	}
+
+	pubSub := mjpegproxy.NewPubSub(id, conf.Path, chunker, standby)
+	pubSub.Options = options
+	pubSub.Eager = conf.Eager
+	pubSub.Access = access
+	err = pubSub.Start()
+	if err != nil {
+		return fmt.Errorf("pubsub[%s]: %s", id, err)
 	}
+	pubSubs = append(pubSubs, pubSub)
+
+	logger.Info("serving", "component", "chunker", "stream", id,
+		"source", chunker.Source(), "path", conf.Path)
+	if standby != nil {
+		logger.Info("standby source", "component", "chunker", "stream", standby.ID(),
+			"source", standby.Source())
+	}
+	// the same paths as servedPaths, checked against each other by validate
+	mux.Handle(conf.Path, mjpegproxy.NewNegotiator(pubSub))
+
+	mux.HandleFunc(subPath(conf.Path, "snapshot"), pubSub.ServeSnapshot)
+	mux.HandleFunc(subPath(conf.Path, "ws"), pubSub.ServeWebSocket)
+	mux.HandleFunc(subPath(conf.Path, "events"), pubSub.ServeEvents)
+
+	if thumbWidth > 0 {
+		mux.Handle(subPath(conf.Path, "thumb"), mjpegproxy.NewThumbnailer(pubSub, thumbWidth))
+	}
+
+	return nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+
+	return pool, nil
+}
+
+// subPath returns the path of an extra endpoint below the stream path.
+func subPath(proxyUrl, name string) string {
+	return strings.TrimSuffix(proxyUrl, "/") + "/" + name
+}
 
-	exists := make(map[string]bool)
+func disabledSource(conf configSource) {
+	logger.Info("disabled", "component", "chunker", "stream", conf.id())
+	mux.HandleFunc(conf.Path, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Stream disabled", http.StatusServiceUnavailable)
+	})
+}
+
+func startSources(sources []configSource) error {
 	for _, conf := range sources {
-		if exists[conf.Path] {
-			return fmt.Errorf("duplicate proxy path: %s", conf.Path)
+		if conf.Enabled != nil && !*conf.Enabled {
+			disabledSource(conf)
+			continue
 		}
 
-		err = startSource(conf.Source, conf.Username, conf.Password, conf.Path, conf.Digest, conf.Rate)
+		err := startSource(conf)
 		if err != nil {
 			return err
 		}
-
-		exists[conf.Path] = true
 	}
 
 	return nil
 }
 
+func setSendBuffer(conn net.Conn) {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		c.SetWriteBuffer(tcpSendBuffer)
+	case *net.UnixConn:
+		c.SetWriteBuffer(tcpSendBuffer)
+	case *tls.Conn:
+		setSendBuffer(c.NetConn())
+	}
+}
+
 func connStateEvent(conn net.Conn, event http.ConnState) {
 	if event == http.StateActive && tcpSendBuffer > 0 {
-		switch c := conn.(type) {
-		case *net.TCPConn:
-			c.SetWriteBuffer(tcpSendBuffer)
-		case *net.UnixConn:
-			c.SetWriteBuffer(tcpSendBuffer)
+		setSendBuffer(conn)
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// checkBindAddress catches malformed listen addresses at startup. The
+// host can be empty, a name or an IP address, with IPv6 ones in
+// brackets; the port a number or a service name.
+func checkBindAddress(addr string) error {
+	if strings.HasPrefix(addr, "unix:") {
+		if strings.TrimPrefix(addr, "unix:") == "" {
+			return fmt.Errorf("bind address %q: missing socket path", addr)
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("bind address %q: IPv6 addresses need brackets, like [::1]:8080", addr)
+		}
+		msg := err.Error()
+		if addrErr, ok := err.(*net.AddrError); ok {
+			msg = addrErr.Err
 		}
+		return fmt.Errorf("bind address %q: %s", addr, msg)
 	}
+
+	if strings.Contains(host, ":") {
+		ip := host
+		if i := strings.IndexByte(ip, '%'); i >= 0 {
+			ip = ip[:i] // zone of a link-local address
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("bind address %q: invalid IPv6 address %s", addr, host)
+		}
+	}
+
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("bind address %q: invalid port %q", addr, port)
+	}
+
+	return nil
 }
 
 func unixListen(path string) (net.Listener, error) {
@@ -118,10 +289,19 @@ func unixListen(path string) (net.Listener, error) {
 	return net.Listen("unix", path)
 }
 
-func listenAndServe(addr string) error {
+func listenAndServe(addr, certFile, keyFile, tlsMinVersion string) error {
 	var listener net.Listener
 	var err error
 
+	useTLS := certFile != "" || keyFile != ""
+	if useTLS && (certFile == "" || keyFile == "") {
+		return errors.New("both -cert and -key are needed for TLS")
+	}
+	minVersion, ok := tlsVersions[tlsMinVersion]
+	if useTLS && !ok {
+		return fmt.Errorf("unknown TLS version: %s", tlsMinVersion)
+	}
+
 	if strings.HasPrefix(addr, "unix:") {
 		listener, err = unixListen(strings.TrimPrefix(addr, "unix:"))
 	} else {
@@ -131,47 +311,336 @@ func listenAndServe(addr string) error {
 		return err
 	}
 
-	fmt.Printf("server: starting on address %s\n", addr)
+	// The streams are long running responses, so WriteTimeout is off by
+	// default: it is a deadline for writing the whole response, and a
+	// value of a few seconds would cut off every viewer after that time.
+	// Clients that stop reading are left to the frame drops instead. The
+	// read timeouts only cover receiving the request.
 	server := &http.Server{
-		ConnState: connStateEvent,
+		Handler:           mux,
+		ConnState:         connStateEvent,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+
+	// closing the server closes the listener, which also removes the
+	// file of a UNIX socket
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", "component", "server", "signal", sig.String())
+		server.Close()
+	}()
+
+	if useTLS {
+		logger.Info("starting", "component", "server", "addr", addr, "tls", true)
+		server.TLSConfig = &tls.Config{MinVersion: minVersion}
+		err = server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		logger.Info("starting", "component", "server", "addr", addr)
+		err = server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	return server.Serve(listener)
+	return err
 }
 
 func main() {
-	source := flag.String("source", "http://example.com/img.mjpg", "source uri")
+	var sourceList, pathList, nameList, headerList, tokenList, responseHeaderList, fallbackList, partHeaderList stringList
+	flag.Var(&sourceList, "source", "source uri, repeat together with -path for more streams (default http://example.com/img.mjpg)")
+	eager := flag.Bool("eager", false, "keep the sources connected even without clients")
+	standby := flag.String("standby", "", "standby source uri kept connected for failover")
+	flag.Var(&fallbackList, "fallback", "fallback source uri tried in turn when connecting fails, can be repeated")
 	username := flag.String("username", "", "source uri username")
 	password := flag.String("password", "", "source uri password")
+	sourceCA := flag.String("source-ca", "", "CA bundle for verifying HTTPS sources")
 	digest := flag.Bool("digest", false, "source uri uses digest authentication")
-	sources := flag.String("sources", "", "JSON configuration file to load sources from")
+	flag.Var(&headerList, "header", "extra \"Key: Value\" header for the source request, can be repeated")
+	flag.Var(&responseHeaderList, "set-header", "\"Key: Value\" header for the client responses, replacing the proxy's own, can be repeated")
+	flag.Var(&partHeaderList, "part-header", "source part header passed on to the clients, * for all, \"Key:\" to remove or \"Key: Value\" to set, can be repeated")
+	configFile := flag.String("config", "", "JSON configuration file to load streams from")
+	flag.StringVar(configFile, "sources", "", "deprecated alias for -config")
 	bind := flag.String("bind", ":8080", "proxy bind address")
-	path := flag.String("path", "/", "proxy serving path")
+	certFile := flag.String("cert", "", "TLS certificate file for serving HTTPS")
+	keyFile := flag.String("key", "", "TLS key file for serving HTTPS")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.Var(&pathList, "path", "proxy serving path, one for each -source (default /)")
+	flag.Var(&nameList, "name", "stream name used in logs and metrics, one for each -source (default is path)")
 	rate := flag.Float64("rate", 0, "limit output frame rate")
+	statsdAddr := flag.String("statsd", "", "StatsD server address to send metrics to")
+	statsdPrefix := flag.String("statsd-prefix", "mjpeg-proxy", "StatsD metric name prefix")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "StatsD send interval")
+	flag.StringVar(&viewerPath, "viewer", "", "serving path for an HTML page showing the streams")
+	flag.StringVar(&statusPath, "status", "/status", "serving path for JSON stream status (empty to disable)")
+	flag.StringVar(&metricsPath, "metrics", "/metrics", "serving path for Prometheus metrics (empty to disable)")
+	pprofAddr := flag.String("pprof-addr", "", "serve the Go profiling endpoints on this separate address, like localhost:6060")
+	readyMaxAge := flag.Duration("ready-max-age", 10*time.Second, "report not ready on /readyz when the last frame is older")
+	cors := flag.String("cors-origin", "", "comma separated origins allowed to load the streams with CORS, * for any")
+	allow := flag.String("allow", "", "comma separated CIDR ranges of clients allowed to connect")
+	deny := flag.String("deny", "", "comma separated CIDR ranges of clients refused, checked before -allow")
+	referers := flag.String("referers", "", "comma separated hosts allowed to embed the streams")
+	cpuHigh := flag.Float64("cpu-high", 0, "lower output frame rate above this CPU share (0-1)")
+	cpuLow := flag.Float64("cpu-low", 0.5, "restore output frame rate below this CPU share (0-1)")
+	cpuMinFPS := flag.Float64("cpu-min-fps", 1, "lowest output frame rate when throttling for CPU")
+	cpuInterval := flag.Duration("cpu-interval", 5*time.Second, "CPU usage check interval")
 	maxprocs := flag.Int("maxprocs", 0, "limit number of CPUs used")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "limit clients sending the request headers")
+	flag.DurationVar(&readTimeout, "read-timeout", 30*time.Second, "limit reading client requests (0 for none)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "limit writing a response, also ends streams after this time (0 for none)")
+	flag.DurationVar(&httpIdleTimeout, "http-idle-timeout", 2*time.Minute, "close idle keep-alive client connections after this time")
+	flag.BoolVar(&sourceInsecure, "source-insecure", false, "skip certificate verification of HTTPS sources")
+	flag.DurationVar(&connectTimeout, "connect-timeout", 10*time.Second, "limit connecting to source and waiting for its headers")
 	flag.DurationVar(&frameTimeout, "frametimeout", 60*time.Second, "limit waiting for next frame")
-	flag.DurationVar(&stopDelay, "stopduration", 60*time.Second, "follow source after last client")
+	flag.DurationVar(&frameTimeout, "stall-timeout", 60*time.Second, "alias for -frametimeout")
+	flag.DurationVar(&options.StopDelay, "stopduration", 60*time.Second, "follow source after last client")
+	flag.DurationVar(&options.StopDelay, "idle-timeout", 60*time.Second, "alias for -stopduration")
 	flag.IntVar(&tcpSendBuffer, "sendbuffer", 4096, "limit buffering of frames")
-	flag.StringVar(&clientHeader, "clientheader", "", "request header with client address")
+	flag.IntVar(&options.ClientBuffer, "client-buffer", 1, "frames queued for each client, more drop less but add latency")
+	flag.StringVar(&options.DropPolicy, "drop-policy", mjpegproxy.DropNew, "frame to drop for clients with a full queue: drop-new or drop-old")
+	flag.StringVar(&options.Boundary, "boundary", "", "multipart boundary sent to clients instead of a random one")
+	flag.BoolVar(&options.ClientCompat, "client-compat", false, "frame the parts for legacy VLC and ffmpeg clients")
+	flag.BoolVar(&options.FrameSeq, "frame-seq", false, "add an X-Frame-Sequence header to each part, for finding dropped frames")
+	flag.IntVar(&options.WriteBuffer, "writebuffer", 0, "buffer writes to clients and flush once per frame")
+	flag.Int64Var(&maxFrameSize, "max-frame", 8<<20, "limit size of source frames in bytes (0 for no limit)")
+	flag.IntVar(&maxHeaderSize, "max-header", 16<<10, "limit size of the part headers of source frames in bytes")
+	flag.BoolVar(&validateJPEG, "validate-jpeg", false, "drop source frames without JPEG start and end markers")
+	flag.BoolVar(&strictMultipart, "strict-multipart", false, "only accept multipart/x-mixed-replace sources, not other multipart types")
+	flag.IntVar(&freezeFrames, "freeze-frames", 0, "warn when the source repeats the same frame this many times (0 to disable)")
+	flag.DurationVar(&freezeTime, "freeze-time", 30*time.Second, "minimum time the frame must repeat to count as frozen")
+	flag.BoolVar(&freezeReconnect, "freeze-reconnect", false, "reconnect to the source when it looks frozen")
+	flag.BoolVar(&allowEmptyChunks, "allow-empty-chunks", false, "skip empty source parts instead of reconnecting")
+	flag.IntVar(&readBuffer, "read-buffer", 64<<10, "size of the buffer for reading the source stream in bytes")
+	flag.BoolVar(&pooledRead, "pooledread", false, "read frames into pooled buffers, reused once all the clients have written them")
+	flag.DurationVar(&options.SnapshotTimeout, "snapshot-timeout", 10*time.Second, "limit waiting for a frame for <path>/snapshot")
+	flag.StringVar(&options.ArchiveDir, "snapshot-dir", "", "save a frame of each stream to this directory every -snapshot-interval")
+	flag.DurationVar(&options.ArchiveInterval, "snapshot-interval", time.Minute, "interval of the frames saved to -snapshot-dir")
+	placeholder := flag.String("placeholder", "", "JPEG image sent to the clients while a source is reconnecting")
+	flag.StringVar(&recordFile, "record-file", "", "record the streams to this file, with the stream name added for several streams")
+	flag.Int64Var(&recordMaxSize, "record-max-size", 1<<30, "rotate the recording to <file>.1 above this size in bytes (0 for no limit)")
+	flag.IntVar(&thumbWidth, "thumbwidth", 0, "serve thumbnails of this width under <path>/thumb")
+	flag.DurationVar(&options.MassDisconnectWindow, "massdisconnect", 2*time.Second, "report all clients failing within this interval")
+	flag.Float64Var(&options.MaxFPS, "max-fps", 0, "limit frame rate sent to each client, lower rates can be asked with ?fps=")
+	flag.Float64Var(&options.OutputFPS, "output-fps", 0, "publish at most this frame rate to all the clients, dropping the other source frames")
+	totalBandwidth := flag.Float64("total-bandwidth", 0, "limit the bandwidth of all the clients together in KB/s (0 for no limit)")
+	flag.IntVar(&options.MaxSubscribers, "max-clients", 0, "limit concurrent clients of each stream")
+	flag.IntVar(&options.MaxClientsPerIP, "max-clients-per-ip", 0, "limit connections per client address to each stream")
+	flag.DurationVar(&options.MaxSession, "max-session", 0, "end client streams after this time, clients can reconnect (0 for no limit)")
+	flag.StringVar(&access.User, "client-user", "", "require Basic auth from clients with this username")
+	flag.StringVar(&access.Pass, "client-pass", "", "require Basic auth from clients with this password")
+	flag.Var(&tokenList, "token", "allow clients with this ?token= or X-Auth-Token, can be repeated")
+	flag.BoolVar(&access.AllowEmptyReferer, "allow-empty-referer", true, "allow requests without Referer or Origin when -referers is set")
+	flag.IntVar(&maxRedirects, "max-redirects", 10, "redirects followed when connecting to the source (0 to refuse them)")
+	flag.IntVar(&retryMax, "retry-max", 0, "reconnect attempts after losing the source")
+	flag.DurationVar(&retryBase, "retry-base", 500*time.Millisecond, "initial wait between reconnect attempts")
+	flag.DurationVar(&retryCap, "retry-cap", 30*time.Second, "longest wait between reconnect attempts")
+	flag.StringVar(&backoffJitter, "backoff-jitter", "full", "reconnect jitter strategy: none, full, equal or decorrelated")
+	flag.Int64Var(&options.DropWarn, "drop-warn", 100, "warn each time a client misses this many frames")
+	flag.StringVar(&access.ClientHeader, "clientheader", "", "request header with client address")
+	flag.BoolVar(&access.TrustProxy, "trust-proxy", false, "take client address from X-Forwarded-For or X-Real-IP")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated CIDR ranges of proxies for -trust-proxy and -clientheader (default loopback)")
+	webhookURL := flag.String("webhook-url", "", "POST a JSON message to this URL when a stream goes down or comes back up")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	check := flag.Bool("check", false, "connect to the sources, read a few frames and exit")
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	var err error
+	logger, err = newLogger(os.Stdout, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "config:", err)
+		os.Exit(1)
+	}
+	mjpegproxy.SetLogger(logger)
+	logger.Info("mjpeg-proxy", "version", proxyVersion(), "commit", commit,
+		"built", buildDate, "go", runtime.Version())
+
+	access.Referers = mjpegproxy.ParseReferers(*referers)
+	access.CORSOrigins = mjpegproxy.ParseOrigins(*cors)
+
+	access.Allowed, err = mjpegproxy.ParseCIDRs(*allow)
+	if err == nil {
+		access.Denied, err = mjpegproxy.ParseCIDRs(*deny)
+	}
+	if err == nil {
+		access.TrustedProxies, err = mjpegproxy.ParseCIDRs(*trustedProxies)
+	}
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
+	if _, err := mjpegproxy.NewBackoff(retryBase, retryCap, backoffJitter); err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	options.RetryBase = retryBase
+	options.RetryCap = retryCap
+	options.Jitter = backoffJitter
+	options.FrameTimeout = frameTimeout
+	options.OutputFPSCap = getOutputFPSCap
+	if *totalBandwidth > 0 {
+		options.TotalBandwidth = mjpegproxy.NewBandwidth(*totalBandwidth * 1024)
+	}
+	options.PartHeaders = partHeaderList
+	options.ResponseHeaders, err = parseHeaders(responseHeaderList)
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
+	if err := checkBindAddress(*bind); err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	if *pprofAddr != "" {
+		err := checkBindAddress(*pprofAddr)
+		if err == nil && strings.HasPrefix(*pprofAddr, "unix:") {
+			err = errors.New("-pprof-addr needs a TCP address")
+		}
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if readBuffer < 1024 {
+		logger.Error("invalid configuration", "err", fmt.Sprintf("read buffer too small: %d", readBuffer))
+		os.Exit(1)
+	}
+
+	if *sourceCA != "" {
+		sourceRootCAs, err = loadCertPool(*sourceCA)
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *placeholder != "" {
+		options.Placeholder, err = ioutil.ReadFile(*placeholder)
+		if err != nil {
+			logger.Error("invalid configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	if *maxprocs > 0 {
 		runtime.GOMAXPROCS(*maxprocs)
 	}
 
-	var err error
-	if *sources != "" {
-		err = loadConfig(*sources)
+	if *webhookURL != "" {
+		webhook = mjpegproxy.NewWebhook(*webhookURL)
+		webhook.Start()
+	}
+
+	var config *Config
+	if *configFile != "" {
+		config, err = LoadConfig(*configFile)
 	} else {
-		err = startSource(*source, *username, *password, *path, *digest, *rate)
+		var headers map[string]string
+		headers, err = parseHeaders(headerList)
+		if err == nil {
+			config, err = flagSources(sourceList, pathList, nameList, configSource{
+				Standby:   *standby,
+				Fallbacks: fallbackList,
+				Eager:     *eager,
+				Username:  *username,
+				Password:  *password,
+				Digest:    *digest,
+				Headers:   headers,
+				Rate:      *rate,
+			})
+		}
+	}
+	if err == nil && *check {
+		err = checkSources(config.Streams)
+		if err != nil {
+			logger.Error("check failed", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if err == nil {
+		access.Tokens = append(tokenList, config.Tokens...)
+		err = startSources(config.Streams)
 	}
 	if err != nil {
-		fmt.Println("config:", err)
+		logger.Error("invalid configuration", "err", err)
 		os.Exit(1)
 	}
 
-	err = listenAndServe(*bind)
+	if recordFile != "" {
+		for _, pubSub := range pubSubs {
+			filename := recordFile
+			if len(pubSubs) > 1 {
+				filename = mjpegproxy.RecordFileName(recordFile, pubSub.ID())
+			}
+			recorder, err := mjpegproxy.NewRecorder(pubSub, filename, recordMaxSize)
+			if err != nil {
+				logger.Error("recorder setup failed", "err", err)
+				os.Exit(1)
+			}
+			recorder.Start()
+		}
+	}
+
+	health := mjpegproxy.NewHealth(pubSubs, *readyMaxAge)
+	mux.HandleFunc("/healthz", health.ServeLive)
+	mux.HandleFunc("/readyz", health.ServeReady)
+
+	if viewerPath != "" {
+		mux.Handle(viewerPath, mjpegproxy.NewViewer(pubSubs, access))
+	}
+
+	admin := mjpegproxy.NewAdmin(pubSubs, access)
+	mux.Handle("/admin/restart", admin)
+	mux.HandleFunc("/debug/source", admin.ServeSource)
+
+	if statusPath != "" {
+		mux.Handle(statusPath, mjpegproxy.NewStatusPage(pubSubs, access))
+	}
+
+	if *pprofAddr != "" {
+		if err := startPprof(*pprofAddr); err != nil {
+			logger.Error("pprof server failed", "component", "pprof", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if metricsPath != "" {
+		mux.Handle(metricsPath, mjpegproxy.NewMetrics(pubSubs))
+	}
+
+	if *statsdAddr != "" {
+		statsd, err := mjpegproxy.NewStatsD(*statsdAddr, *statsdPrefix, *statsdInterval, pubSubs)
+		if err != nil {
+			logger.Error("statsd setup failed", "err", err)
+			os.Exit(1)
+		}
+		statsd.Start()
+	}
+
+	if *cpuHigh > 0 {
+		throttle, err := NewCPUThrottle(*cpuHigh, *cpuLow, *cpuMinFPS, *cpuInterval, pubSubs)
+		if err != nil {
+			logger.Error("cpu throttle setup failed", "err", err)
+			os.Exit(1)
+		}
+		throttle.Start()
+	}
+
+	err = listenAndServe(*bind, *certFile, *keyFile, *tlsMinVersion)
 	if err != nil {
-		fmt.Println("server:", err)
+		logger.Error("server failed", "err", err)
 		os.Exit(1)
 	}
 }
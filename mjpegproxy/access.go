@@ -0,0 +1,383 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Access decides which clients may watch the streams and how they are
+// identified. A nil *Access lets everyone in, as does the zero value.
+type Access struct {
+	ClientHeader string // request header with the client address
+	TrustProxy   bool   // take the address from X-Forwarded-For or X-Real-IP
+
+	TrustedProxies []*net.IPNet // proxies sending the headers, empty for loopback
+
+	Allowed []*net.IPNet // client ranges allowed, empty for any
+	Denied  []*net.IPNet // client ranges refused, checked first
+
+	Referers          []string // hosts allowed to embed the streams
+	AllowEmptyReferer bool     // let requests without Referer or Origin in
+
+	CORSOrigins []string // origins allowed to load the streams, "*" for any
+
+	User   string   // Basic auth username clients must send
+	Pass   string   // Basic auth password clients must send
+	Tokens []string // access tokens accepted instead
+}
+
+// ParseReferers turns a comma separated list of hosts or origins into
+// the list of hosts allowed to embed the streams.
+func ParseReferers(list string) []string {
+	hosts := make([]string, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "://") {
+			u, err := url.Parse(s)
+			if err == nil {
+				s = u.Host
+			}
+		}
+		hosts = append(hosts, strings.ToLower(s))
+	}
+	return hosts
+}
+
+// refererAllowed checks the embedding page against the allowed hosts.
+// Origin is preferred when present since browsers send it reliably for
+// cross-site requests. Allowed hosts without a port match any port.
+func (access *Access) RefererAllowed(r *http.Request) bool {
+	if access == nil || len(access.Referers) == 0 {
+		return true
+	}
+
+	ref := r.Header.Get("Origin")
+	if ref == "" || ref == "null" {
+		ref = r.Header.Get("Referer")
+	}
+	if ref == "" {
+		return access.AllowEmptyReferer
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(u.Host)
+	hostname := strings.ToLower(u.Hostname())
+	for _, allowed := range access.Referers {
+		if allowed == host || allowed == hostname {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseCIDRs parses a comma separated list of CIDR ranges. Plain
+// addresses are taken as a range of one.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddress returns the address of the client, taken from the proxy
+// headers only when ClientHeader or TrustProxy asks for it and the
+// request comes from a trusted proxy.
+func (access *Access) ClientAddress(r *http.Request) string {
+	client := r.RemoteAddr
+	if access == nil || access.ClientHeader == "" && !access.TrustProxy {
+		return client
+	}
+	if !access.trustedProxy(r.RemoteAddr) {
+		return client
+	}
+
+	if access.ClientHeader != "" {
+		if forwarded := access.forwardedFor(r.Header.Get(access.ClientHeader)); forwarded != "" {
+			client = forwarded
+		}
+	} else {
+		forwarded := access.forwardedFor(r.Header.Get("X-Forwarded-For"))
+		if forwarded == "" {
+			forwarded = strings.TrimSpace(r.Header.Get("X-Real-IP"))
+		}
+		if forwarded != "" {
+			client = forwarded
+		}
+	}
+
+	return client
+}
+
+// trustedProxy reports whether the headers of a request from this
+// address can be believed. Without TrustedProxies only a proxy on the
+// same host is trusted.
+func (access *Access) trustedProxy(addr string) bool {
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return false
+	}
+	if len(access.TrustedProxies) == 0 {
+		return ip.IsLoopback()
+	}
+	return containsIP(access.TrustedProxies, ip)
+}
+
+// forwardedFor picks the client from a list of addresses like the one in
+// X-Forwarded-For. Each proxy appends the address it got the request
+// from, so the list is walked from the right past the trusted proxies.
+// The entries further left come from the client and can be made up.
+func (access *Access) forwardedFor(header string) string {
+	hosts := strings.Split(header, ",")
+	for i := len(hosts) - 1; i >= 0; i-- {
+		host := strings.TrimSpace(hosts[i])
+		if host == "" {
+			continue
+		}
+		if i == 0 || !access.trustedProxy(host) {
+			return host
+		}
+	}
+	return ""
+}
+
+// AddressAllowed checks the client address against Denied and Allowed,
+// denying first.
+func (access *Access) AddressAllowed(r *http.Request) bool {
+	if access == nil || len(access.Allowed) == 0 && len(access.Denied) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP(access.ClientAddress(r)))
+	if ip == nil {
+		return false
+	}
+	if containsIP(access.Denied, ip) {
+		return false
+	}
+	return len(access.Allowed) == 0 || containsIP(access.Allowed, ip)
+}
+
+// AuthConfigured reports whether the clients need credentials or a token.
+func (access *Access) AuthConfigured() bool {
+	return access != nil && (access.basicAuth() || len(access.Tokens) > 0)
+}
+
+func (access *Access) basicAuth() bool {
+	return access.User != "" || access.Pass != ""
+}
+
+// clientAuthorized checks the Basic auth credentials of the client. The
+// hashes are compared so that the time taken does not depend on the
+// length or contents of the configured values.
+func (access *Access) clientAuthorized(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+
+	userOk := secretEqual(user, access.User)
+	passOk := secretEqual(pass, access.Pass)
+	return userOk && passOk
+}
+
+// requestToken returns the access token of the request, from the token
+// query parameter or the X-Auth-Token header.
+func requestToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return r.Header.Get("X-Auth-Token")
+}
+
+// tokenAuthorized checks the token against all the configured ones,
+// without stopping at the first match.
+func (access *Access) tokenAuthorized(token string) bool {
+	found := false
+	for _, valid := range access.Tokens {
+		if secretEqual(token, valid) {
+			found = true
+		}
+	}
+	return found
+}
+
+func secretEqual(a, b string) bool {
+	hashA := sha256.Sum256([]byte(a))
+	hashB := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(hashA[:], hashB[:]) == 1
+}
+
+// RequireAuth lets the request through with a valid token or Basic auth
+// credentials, when either is configured. A wrong token is refused with
+// 403, missing credentials get a 401 challenge when Basic auth is on.
+// It returns false when the request should not be served.
+func (access *Access) RequireAuth(w http.ResponseWriter, r *http.Request) bool {
+	if !access.AuthConfigured() {
+		return true
+	}
+	basicAuth := access.basicAuth()
+
+	token := requestToken(r)
+	if token != "" && access.tokenAuthorized(token) {
+		return true
+	}
+	if basicAuth && access.clientAuthorized(r) {
+		return true
+	}
+
+	if basicAuth && token == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mjpeg-proxy", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// ParseOrigins splits a comma separated list of CORS origins. A "*"
+// allows any origin.
+func ParseOrigins(list string) []string {
+	origins := make([]string, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimRight(strings.TrimSpace(s), "/")
+		if s != "" {
+			origins = append(origins, s)
+		}
+	}
+	return origins
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin value for the
+// request, empty when the origin is not allowed.
+func (access *Access) corsOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range access.CORSOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// originAllowed checks the Origin of a WebSocket handshake, as the same
+// origin policy does not apply to WebSockets. Pages from the proxy
+// itself and the CORS origins may open one. Without an Origin the
+// client is not a browser and is let in.
+func (access *Access) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return access != nil && access.corsOrigin(r) != ""
+}
+
+// HandleCORS adds the CORS headers to the response and answers preflight
+// requests, returning true when the request was handled.
+func (access *Access) HandleCORS(w http.ResponseWriter, r *http.Request) bool {
+	if access == nil || len(access.CORSOrigins) == 0 {
+		return false
+	}
+
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	origin := access.corsOrigin(r)
+	if origin != "" {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if r.Method != http.MethodOptions {
+		return false
+	}
+
+	if origin != "" {
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			header.Set("Access-Control-Allow-Headers", headers)
+		}
+		header.Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+
+	return true
+}
+
+// AllowedMethods lists the methods for the Allow header of the stream
+// endpoints.
+func (access *Access) AllowedMethods() string {
+	if access != nil && len(access.CORSOrigins) > 0 {
+		return "GET, HEAD, OPTIONS"
+	}
+	return "GET, HEAD"
+}
@@ -0,0 +1,133 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddressAllowed(t *testing.T) {
+	var access Access
+	var err error
+	access.Allowed, err = ParseCIDRs("192.168.1.0/24, 10.0.0.1, fd00::/8")
+	if err != nil {
+		t.Fatalf("ParseCIDRs: %s", err)
+	}
+	access.Denied, err = ParseCIDRs("192.168.1.66")
+	if err != nil {
+		t.Fatalf("ParseCIDRs: %s", err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{"192.168.1.10:5000", true},
+		{"192.168.1.66:5000", false},
+		{"192.168.2.10:5000", false},
+		{"10.0.0.1:5000", true},
+		{"10.0.0.2:5000", false},
+		{"[fd00::1]:5000", true},
+		{"[::1]:5000", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if got := access.AddressAllowed(r); got != tt.want {
+			t.Errorf("AddressAllowed(%s) = %v, want %v", tt.remoteAddr, got, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	for _, list := range []string{"192.168.1.0/33", "example.com", "10.0.0.1/8, nope"} {
+		if _, err := ParseCIDRs(list); err == nil {
+			t.Errorf("ParseCIDRs(%q) succeeded", list)
+		}
+	}
+}
+
+func TestTrustProxy(t *testing.T) {
+	tests := []struct {
+		trust     bool
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{false, "203.0.113.7", "", "127.0.0.1:5000"},
+		{true, "203.0.113.7, 10.0.0.1", "198.51.100.1", "10.0.0.1"},
+		{true, "", "198.51.100.1", "198.51.100.1"},
+		{true, "", "", "127.0.0.1:5000"},
+	}
+
+	for _, tt := range tests {
+		access := &Access{TrustProxy: tt.trust}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "127.0.0.1:5000"
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := access.ClientAddress(r); got != tt.want {
+			t.Errorf("ClientAddress(trust=%v, %q, %q) = %s, want %s", tt.trust, tt.forwarded, tt.realIP, got, tt.want)
+		}
+	}
+}
+
+func TestTrustProxySpoofed(t *testing.T) {
+	proxies, err := ParseCIDRs("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDRs: %s", err)
+	}
+
+	tests := []struct {
+		header     string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		// the client made up the left-most entry
+		{"", "10.0.0.1:5000", "192.168.1.10, 203.0.113.7", "203.0.113.7"},
+		{"", "10.0.0.1:5000", "192.168.1.10, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"", "10.0.0.1:5000", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"X-Client", "10.0.0.1:5000", "192.168.1.10, 203.0.113.7", "203.0.113.7"},
+		// not from a trusted proxy
+		{"", "203.0.113.9:5000", "192.168.1.10", "203.0.113.9:5000"},
+		{"X-Client", "203.0.113.9:5000", "192.168.1.10", "203.0.113.9:5000"},
+	}
+
+	for _, tt := range tests {
+		access := &Access{ClientHeader: tt.header, TrustProxy: true, TrustedProxies: proxies}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		name := tt.header
+		if name == "" {
+			name = "X-Forwarded-For"
+		}
+		r.Header.Set(name, tt.forwarded)
+		if got := access.ClientAddress(r); got != tt.want {
+			t.Errorf("ClientAddress(%s, %s: %q) = %s, want %s", tt.remoteAddr, name, tt.forwarded, got, tt.want)
+		}
+	}
+}
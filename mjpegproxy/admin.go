@@ -0,0 +1,168 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var errNotRunning = errors.New("stream not running")
+
+// Restart drops the source connection and connects again, for sources
+// that wedge. The subscribers stay and get the frames of the new
+// connection. Like the other changes to the chunker it is done by the
+// loop, which answers once the source is connected again.
+func (pubSub *PubSub) Restart() error {
+	reply := make(chan error, 1)
+	pubSub.cycleChan <- reply
+	return <-reply
+}
+
+func (pubSub *PubSub) doRestart(reply chan error) {
+	if pubSub.pubChan == nil && !pubSub.onStandby && !pubSub.connecting {
+		reply <- errNotRunning
+		return
+	}
+
+	pubSub.log.Info("restarting source")
+	pubSub.stopChunker()
+	pubSub.onStandby = false
+
+	pubSub.restartReplies = append(pubSub.restartReplies, reply)
+	pubSub.startChunker()
+}
+
+// Admin handles the administrative requests, like POST
+// /admin/restart?stream=/cam1, and GET /debug/source?stream=/cam1 with
+// ServeSource. They need the client credentials or a token and are
+// refused when neither is configured.
+type Admin struct {
+	pubSubs []*PubSub
+	access  *Access
+}
+
+func NewAdmin(pubSubs []*PubSub, access *Access) *Admin {
+	admin := new(Admin)
+
+	admin.pubSubs = pubSubs
+	admin.access = access
+
+	return admin
+}
+
+// authorize runs the checks of the admin requests, answering the
+// request itself when the client is refused.
+func (admin *Admin) authorize(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if !admin.access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+
+	if !admin.access.AuthConfigured() {
+		http.Error(w, "Admin requests need client credentials or a token", http.StatusForbidden)
+		return false
+	}
+
+	return admin.access.RequireAuth(w, r)
+}
+
+// stream finds the stream of the ?stream= parameter, by path or name.
+// It can be left out when there is only one.
+func (admin *Admin) stream(r *http.Request) *PubSub {
+	stream := r.URL.Query().Get("stream")
+	var pubSub *PubSub
+	for _, p := range admin.pubSubs {
+		if p.path == stream || p.id == stream || (stream == "" && len(admin.pubSubs) == 1) {
+			pubSub = p
+		}
+	}
+	return pubSub
+}
+
+func (admin *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !admin.authorize(w, r, http.MethodPost) {
+		return
+	}
+
+	pubSub := admin.stream(r)
+	if pubSub == nil {
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	}
+
+	logger.Info("admin restart", "component", "admin", "stream", pubSub.id,
+		"client", admin.access.ClientAddress(r))
+
+	result := map[string]string{"stream": pubSub.path, "result": "restarted"}
+	status := http.StatusOK
+
+	err := pubSub.Restart()
+	if err == errNotRunning {
+		result["result"] = "not running"
+	} else if err != nil {
+		result["result"] = "failed"
+		result["error"] = err.Error()
+		status = http.StatusBadGateway
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// ServeSource shows what the source of a stream answered to the last
+// connect: the status, the headers and the boundary found in them, for
+// debugging cameras without capturing the traffic.
+func (admin *Admin) ServeSource(w http.ResponseWriter, r *http.Request) {
+	if !admin.authorize(w, r, http.MethodGet) {
+		return
+	}
+
+	pubSub := admin.stream(r)
+	if pubSub == nil {
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	}
+
+	result := struct {
+		Stream    string          `json:"stream"`
+		Source    string          `json:"source"`
+		Connected bool            `json:"connected"`
+		Response  *SourceResponse `json:"response"`
+	}{
+		Stream:    pubSub.path,
+		Source:    pubSub.chunker.Source(),
+		Connected: pubSub.chunker.Connected(),
+		Response:  pubSub.chunker.LastResponse(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,134 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminRestart(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	access := new(Access)
+	admin := NewAdmin([]*PubSub{pubSub}, access)
+
+	restart := func(target, token string) int {
+		r := httptest.NewRequest(http.MethodPost, target, nil)
+		if token != "" {
+			r.Header.Set("X-Auth-Token", token)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := restart("/admin/restart?stream=/test", ""); code != http.StatusForbidden {
+		t.Errorf("without auth configured: status = %d, want %d", code, http.StatusForbidden)
+	}
+
+	access.Tokens = []string{"admin"}
+
+	if code := restart("/admin/restart?stream=/test", "wrong"); code != http.StatusForbidden {
+		t.Errorf("wrong token: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := restart("/admin/restart?stream=/nope", "admin"); code != http.StatusNotFound {
+		t.Errorf("unknown stream: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	sub := NewSubscriber("test", 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	<-sub.ChunkChannel
+
+	if code := restart("/admin/restart?stream=/test", "admin"); code != http.StatusOK {
+		t.Fatalf("restart: status = %d, want %d", code, http.StatusOK)
+	}
+
+	// the subscriber stays and gets the frames of the new connection
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok || !isTestFrame(frame.Data) {
+			t.Fatalf("after restart got %q, %v", frame.Data, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame after restart")
+	}
+}
+
+func TestAdminSource(t *testing.T) {
+	server := sourceServer(t, "text/html", "<html>Login</html>")
+	pubSub := newTestPubSub(t, server.URL)
+	access := &Access{Tokens: []string{"admin"}}
+	admin := NewAdmin([]*PubSub{pubSub}, access)
+
+	get := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/debug/source?stream=/test", nil)
+		if token != "" {
+			r.Header.Set("X-Auth-Token", token)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeSource(w, r)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusForbidden {
+		t.Errorf("without token: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	var result struct {
+		Connected bool
+		Response  *SourceResponse
+	}
+	w := get("admin")
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if result.Response != nil {
+		t.Errorf("response before connecting: %+v", result.Response)
+	}
+
+	// a failed connect is kept too, that's when it is most useful
+	if err := pubSub.chunker.Connect(); err == nil {
+		t.Fatal("connected to an HTML page")
+	}
+	w = get("admin")
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	response := result.Response
+	if result.Connected || response == nil || response.Status != "200 OK" ||
+		response.Header.Get("Content-Type") != "text/html" || response.Error == "" {
+		t.Errorf("unexpected source info: %+v", response)
+	}
+
+	live := liveSourceServer(t)
+	chunker := newTestChunker(t, live.URL)
+	if err := chunker.Connect(); err != nil {
+		t.Fatalf("Connect: %s", err)
+	}
+	defer chunker.closeResponse(chunker.resp)
+	if response := chunker.LastResponse(); response.Boundary != "myboundary" || response.Error != "" {
+		t.Errorf("live source info: %+v", response)
+	}
+}
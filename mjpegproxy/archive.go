@@ -0,0 +1,100 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// archive saves the cached frame to ArchiveDir, for timelapses.
+// The loop only hands the frame over, the writing is done on the side
+// and skipped while the previous write is still going on, so a slow or
+// full disk never holds up the clients. Nothing is saved while the
+// source is not connected, use an eager stream to record all the time.
+func (pubSub *PubSub) archive(now time.Time) {
+	frame := pubSub.cachedFrame()
+	if frame.Data == nil {
+		pubSub.log.Debug("no frame to archive")
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&pubSub.archiving, 0, 1) {
+		pubSub.log.Warn("archive write still in progress, skipping frame")
+		frame.Release()
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&pubSub.archiving, 0)
+		defer frame.Release()
+
+		filename := filepath.Join(pubSub.ArchiveDir, archiveName(pubSub.id, now))
+		err := writeArchive(filename, frame.Data)
+		if err != nil {
+			pubSub.log.Error("archive write failed", "err", err)
+			return
+		}
+		pubSub.log.Debug("frame archived", "file", filename)
+	}()
+}
+
+// fileSafeName turns the stream name into something usable in file
+// names.
+func fileSafeName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.Trim(id, "/"))
+	if name == "" {
+		name = "stream"
+	}
+	return name
+}
+
+// archiveName returns a file name with the stream name and the time,
+// which sorts in time order.
+func archiveName(id string, t time.Time) string {
+	return fmt.Sprintf("%s-%s.jpg", fileSafeName(id), t.Format("20060102-150405.000"))
+}
+
+// writeArchive writes the frame to a temporary file and renames it into
+// place, so that there are no partial images left on errors.
+func writeArchive(filename string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
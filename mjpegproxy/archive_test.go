@@ -0,0 +1,82 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	source := liveSourceServer(t)
+	// not t.TempDir, the loop can still be writing when the test ends
+	tmp, err := os.MkdirTemp("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "missing", "dir")
+
+	pubSub := NewPubSub("front door", "/cam", newTestChunker(t, source.URL), nil)
+	pubSub.ArchiveDir = dir
+	pubSub.ArchiveInterval = 20 * time.Millisecond
+	pubSub.Start()
+
+	sub := NewSubscriber("test", 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := filepath.Glob(filepath.Join(dir, "front_door-*.jpg"))
+		if len(files) >= 2 {
+			data, err := os.ReadFile(files[0])
+			if err != nil || !isTestFrame(data) {
+				t.Fatalf("%s = %q, %v", files[0], data, err)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d archived frames", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	now := time.Date(2024, 5, 1, 13, 4, 5, 60e6, time.UTC)
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"front-door", "front-door-20240501-130405.060.jpg"},
+		{"/cam/1", "cam_1-20240501-130405.060.jpg"},
+		{"/", "stream-20240501-130405.060.jpg"},
+	}
+
+	for _, tt := range tests {
+		if got := archiveName(tt.id, now); got != tt.want {
+			t.Errorf("archiveName(%q) = %s, want %s", tt.id, got, tt.want)
+		}
+	}
+}
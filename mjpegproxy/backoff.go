@@ -0,0 +1,126 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+/* Jitter strategies for spreading out reconnect attempts:
+
+   none          base * 2^attempt, capped; every client retries in lockstep
+   full          random delay between 0 and the capped exponential delay
+   equal         half of the capped exponential delay plus a random half
+   decorrelated  random delay between base and three times the previous
+                 delay, capped; grows like the exponential one on average
+                 but keeps clients apart even after hitting the cap
+*/
+
+var jitterStrategies = []string{"none", "full", "equal", "decorrelated"}
+
+type Backoff struct {
+	base    time.Duration
+	limit   time.Duration
+	jitter  string
+	attempt int
+	prev    time.Duration
+}
+
+func validJitter(jitter string) error {
+	for _, s := range jitterStrategies {
+		if s == jitter {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown jitter strategy: %s (valid: %v)", jitter, jitterStrategies)
+}
+
+func NewBackoff(base, limit time.Duration, jitter string) (*Backoff, error) {
+	if base <= 0 {
+		return nil, fmt.Errorf("invalid base delay: %s", base)
+	}
+	if limit < base {
+		limit = base
+	}
+	if err := validJitter(jitter); err != nil {
+		return nil, err
+	}
+
+	backoff := new(Backoff)
+
+	backoff.base = base
+	backoff.limit = limit
+	backoff.jitter = jitter
+	backoff.prev = base
+
+	return backoff, nil
+}
+
+// exponential returns the capped delay for the current attempt.
+func (backoff *Backoff) exponential() time.Duration {
+	delay := backoff.base
+	for i := 0; i < backoff.attempt && delay < backoff.limit; i++ {
+		delay *= 2
+	}
+	if delay > backoff.limit {
+		delay = backoff.limit
+	}
+	return delay
+}
+
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// Next returns the delay to wait before the next attempt.
+func (backoff *Backoff) Next() time.Duration {
+	var delay time.Duration
+
+	switch backoff.jitter {
+	case "full":
+		delay = randDuration(backoff.exponential())
+	case "equal":
+		half := backoff.exponential() / 2
+		delay = half + randDuration(half)
+	case "decorrelated":
+		delay = backoff.base + randDuration(backoff.prev*3-backoff.base)
+		if delay > backoff.limit {
+			delay = backoff.limit
+		}
+	default:
+		delay = backoff.exponential()
+	}
+
+	backoff.attempt++
+	backoff.prev = delay
+
+	return delay
+}
+
+// Reset starts over from the base delay.
+func (backoff *Backoff) Reset() {
+	backoff.attempt = 0
+	backoff.prev = backoff.base
+}
@@ -0,0 +1,1232 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Sample source stream starts like this:
+
+   HTTP/1.1 200 OK
+   Content-Type: multipart/x-mixed-replace;boundary=myboundary
+   Cache-Control: no-cache
+   Pragma: no-cache
+
+   --myboundary
+   Content-Type: image/jpeg
+   Content-Length: 36291
+
+   JPEG data...
+*/
+
+// Chunker reads the frames of a MJPEG source. The exported fields are
+// settings, to be changed before Connect.
+type Chunker struct {
+	id        string
+	sources   []*url.URL // the source and its fallbacks
+	current   int32      // index of the source in use
+	fallbacks []string
+	username  string
+	password  string
+	digest    bool
+	digestCh  *digestChallenge
+	client    *http.Client // kept across reconnects, see httpClient
+	resp      *http.Response
+	boundary  string
+	stop      chan struct{}
+	done      chan struct{} // closed once Start returns
+	rate      float64
+	cancel    context.CancelFunc
+	ctx       context.Context
+	stopRun   context.CancelFunc // cancels ctx, called by Stop
+	freeze    freezeDetector
+	connected int32
+	lastFrame int64        // unix nanoseconds of the last frame read
+	interval  uint64       // float64 bits of the average nanoseconds between frames
+	frameType atomic.Value // normalized Content-Type of the last part
+	oddWarned bool         // about an unusual multipart subtype
+
+	responseMutex sync.Mutex
+	response      *SourceResponse // of the last connect, for debugging
+
+	Headers          map[string]string // extra headers of the source request
+	MaxFrameSize     int64             // 0 for no limit
+	MaxHeaderSize    int               // bytes of part headers, 0 for the multipart limit
+	ValidateJPEG     bool              // drop frames without the JPEG markers
+	StrictMultipart  bool              // reject other types than multipart/x-mixed-replace
+	AllowEmptyChunks bool              // skip empty parts instead of failing
+	ReadBuffer       int               // bufio size for the source body
+	PooledRead       bool              // read the frames into pooled buffers, see Frame.Release
+	FrameTimeout     time.Duration     // reconnect when no frame comes for this long
+	FreezeFrames     int               // identical frames for a freeze, 0 to disable
+	FreezeTime       time.Duration     // and the time they must span
+	FreezeReconnect  bool              // reconnect once the source looks frozen
+	MaxRetries       int
+	MaxRedirects     int
+	Backoff          *Backoff // delays between the retries, nil for a fixed delay
+	ConnectTimeout   time.Duration
+	StopTimeout      time.Duration // wait in Stop for the run to end, 0 not to wait
+
+	InsecureSkipVerify bool
+	RootCAs            *x509.CertPool
+
+	// Transport, when set, makes the source requests instead of a client
+	// built from the settings above, for custom proxies or for tests. The
+	// default one uses the proxy from HTTP_PROXY and HTTPS_PROXY.
+	Transport http.RoundTripper
+
+	// OnStateChange, when set, is called with one of the State values as
+	// the source connection changes. It runs on the goroutines of the
+	// chunker, so it should return quickly.
+	OnStateChange func(state string)
+
+	log *slog.Logger
+}
+
+// Errors returned by Connect for sources that don't send an MJPEG stream,
+// usually a configuration problem rather than a passing failure. The
+// detail is wrapped around them, so check with errors.Is.
+var (
+	ErrNotMultipart = errors.New("not an MJPEG stream")
+	ErrNoBoundary   = errors.New("boundary not found")
+)
+
+// Environment variables with the source credentials, used when they are
+// neither given as options nor in the source URL.
+const (
+	EnvSourceUsername = "MJPEG_SOURCE_USERNAME"
+	EnvSourcePassword = "MJPEG_SOURCE_PASSWORD"
+)
+
+// connection states passed to OnStateChange
+const (
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+	StateReconnecting = "reconnecting"
+	StateStopped      = "stopped"
+	StateFailed       = "failed" // connect failed or retries ran out
+)
+
+// ChunkerOption changes a setting of a new chunker.
+type ChunkerOption func(*Chunker)
+
+// WithName sets the stream name used in the logs, the source URL by
+// default.
+func WithName(name string) ChunkerOption {
+	return func(chunker *Chunker) { chunker.id = name }
+}
+
+// WithBasicAuth sends the credentials to the source with Basic auth,
+// unless it asks for digest auth.
+func WithBasicAuth(username, password string) ChunkerOption {
+	return func(chunker *Chunker) {
+		chunker.username, chunker.password = username, password
+		chunker.digest = false
+	}
+}
+
+// WithDigestAuth sends the credentials only with digest auth.
+func WithDigestAuth(username, password string) ChunkerOption {
+	return func(chunker *Chunker) {
+		chunker.username, chunker.password = username, password
+		chunker.digest = true
+	}
+}
+
+// WithRate limits the frames read from the source to fps.
+func WithRate(fps float64) ChunkerOption {
+	return func(chunker *Chunker) { chunker.rate = fps }
+}
+
+// WithTimeout limits connecting to the source and waiting for its
+// response headers.
+func WithTimeout(timeout time.Duration) ChunkerOption {
+	return func(chunker *Chunker) { chunker.ConnectTimeout = timeout }
+}
+
+// WithHeaders adds headers to the source request, replacing the ones
+// of an earlier WithHeaders.
+func WithHeaders(headers map[string]string) ChunkerOption {
+	return func(chunker *Chunker) { chunker.Headers = headers }
+}
+
+// WithMaxFrameSize limits the size of the frames, 0 for no limit.
+func WithMaxFrameSize(size int64) ChunkerOption {
+	return func(chunker *Chunker) { chunker.MaxFrameSize = size }
+}
+
+// WithRetries reconnects up to max times after losing the source,
+// waiting between the attempts as given by backoff.
+func WithRetries(max int, backoff *Backoff) ChunkerOption {
+	return func(chunker *Chunker) {
+		chunker.MaxRetries = max
+		chunker.Backoff = backoff
+	}
+}
+
+// WithTLS sets the verification of HTTPS sources.
+func WithTLS(rootCAs *x509.CertPool, insecureSkipVerify bool) ChunkerOption {
+	return func(chunker *Chunker) {
+		chunker.RootCAs = rootCAs
+		chunker.InsecureSkipVerify = insecureSkipVerify
+	}
+}
+
+// WithFallbacks adds more URLs of the same view. When connecting to a
+// source fails, the next one is tried, going round the list.
+func WithFallbacks(sources ...string) ChunkerOption {
+	return func(chunker *Chunker) { chunker.fallbacks = sources }
+}
+
+// WithTransport makes the source requests with the given transport.
+func WithTransport(transport http.RoundTripper) ChunkerOption {
+	return func(chunker *Chunker) { chunker.Transport = transport }
+}
+
+// NewSourceChunker creates a chunker reading the source URL. The options
+// are applied in order, so later ones win.
+//
+// The username and password from WithBasicAuth or WithDigestAuth take
+// precedence over a user:pass@ in the URL, and those over the
+// EnvSourceUsername and EnvSourcePassword variables, which keep the
+// password out of the process list. Each is looked up on its own, so a
+// username given as an option can go with a password from the
+// environment.
+func NewSourceChunker(source string, opts ...ChunkerOption) (*Chunker, error) {
+	chunker := new(Chunker)
+
+	sourceUrl, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if !sourceUrl.IsAbs() {
+		return nil, fmt.Errorf("uri is not absolute: %s", source)
+	}
+
+	chunker.id = sourceUrl.Redacted()
+	chunker.sources = []*url.URL{sourceUrl}
+	chunker.MaxRedirects = 10
+	chunker.ReadBuffer = 64 << 10
+	chunker.MaxHeaderSize = 16 << 10
+	chunker.StopTimeout = 5 * time.Second
+
+	for _, opt := range opts {
+		opt(chunker)
+	}
+
+	var urlUser, urlPass string
+	if sourceUrl.User != nil {
+		urlUser = sourceUrl.User.Username()
+		urlPass, _ = sourceUrl.User.Password()
+		sourceUrl.User = nil // sent the same way as the other credentials
+	}
+	chunker.username = firstNonEmpty(chunker.username, urlUser, os.Getenv(EnvSourceUsername))
+	chunker.password = firstNonEmpty(chunker.password, urlPass, os.Getenv(EnvSourcePassword))
+
+	for _, fallback := range chunker.fallbacks {
+		fallbackUrl, err := url.Parse(fallback)
+		if err != nil {
+			return nil, fmt.Errorf("fallback: %s", err)
+		}
+		if !fallbackUrl.IsAbs() {
+			return nil, fmt.Errorf("fallback uri is not absolute: %s", fallback)
+		}
+		chunker.sources = append(chunker.sources, fallbackUrl)
+	}
+
+	chunker.log = logger.With("component", "chunker", "stream", chunker.id,
+		"source", sourceUrl.Redacted())
+
+	return chunker, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// NewChunker creates a chunker from the settings of the first versions.
+//
+// Deprecated: use NewSourceChunker, which takes options.
+func NewChunker(id, source, username, password string, digest bool, rate float64) (*Chunker, error) {
+	auth := WithBasicAuth(username, password)
+	if digest {
+		auth = WithDigestAuth(username, password)
+	}
+	return NewSourceChunker(source, WithName(id), auth, WithRate(rate))
+}
+
+func (chunker *Chunker) credentials() bool {
+	return chunker.username != "" && chunker.password != ""
+}
+
+// basicAuthEnabled tells if the credentials should be sent up front. With
+// digest set the password is never sent in the clear, but digest auth is
+// also used without it whenever the source answers with a challenge.
+func (chunker *Chunker) basicAuthEnabled() bool {
+	return chunker.credentials() && !chunker.digest
+}
+
+// newClient returns the client for the source request. Connecting to the
+// source happens in two phases: first the connection is established and
+// the response headers are received, then the body is read for as long
+// as the stream runs. The connect timeout only applies to the first
+// phase, which is why it is set on the transport steps instead of using
+// http.Client.Timeout, which would also cut off the body read. Stalls in
+// the second phase are handled by the frame timeout.
+func (chunker *Chunker) newClient() *http.Client {
+	if chunker.Transport != nil {
+		return &http.Client{Transport: chunker.Transport, CheckRedirect: chunker.checkRedirect}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if timeout := chunker.ConnectTimeout; timeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+
+	if chunker.InsecureSkipVerify || chunker.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: chunker.InsecureSkipVerify,
+			RootCAs:            chunker.RootCAs,
+		}
+	}
+
+	return &http.Client{Transport: transport, CheckRedirect: chunker.checkRedirect}
+}
+
+// httpClient returns the client for the source requests. It is kept
+// across reconnects, so a retry can go over a pooled connection instead
+// of a new TCP and TLS handshake, which also keeps the camera behind a
+// load balancer. The settings are read when it is first made.
+func (chunker *Chunker) httpClient() *http.Client {
+	if chunker.client == nil {
+		chunker.client = chunker.newClient()
+	}
+	return chunker.client
+}
+
+// resetClient drops the pooled connections, for switching to another
+// source. A custom Transport is shared with the caller and left alone.
+func (chunker *Chunker) resetClient() {
+	if chunker.client != nil && chunker.Transport == nil {
+		chunker.client.CloseIdleConnections()
+	}
+	chunker.client = nil
+}
+
+// checkRedirect limits the redirects followed to MaxRedirects and
+// carries the credentials and custom headers over to the new location.
+// The client drops Authorization when redirected to another host, but
+// cameras redirecting to a session URL still need them. Basic auth is
+// not resent when going from HTTPS to plain HTTP. A digest response is
+// only valid for the original URI, the new location answers with a
+// challenge of its own.
+func (chunker *Chunker) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > chunker.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", chunker.MaxRedirects)
+	}
+
+	for key, value := range chunker.Headers {
+		if !strings.EqualFold(key, "Host") {
+			req.Header.Set(key, value)
+		}
+	}
+
+	downgrade := via[0].URL.Scheme == "https" && req.URL.Scheme != "https"
+	if chunker.basicAuthEnabled() && !downgrade {
+		req.SetBasicAuth(chunker.username, chunker.password)
+	}
+
+	chunker.log.Debug("following redirect", "location", req.URL.Redacted())
+	return nil
+}
+
+func (chunker *Chunker) Connect() error {
+	return chunker.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the source for a new run of the chunker.
+// The context covers the whole run: cancelling it aborts a pending
+// connect, the reconnect attempts and the stream itself.
+//
+// A stopped run may still be finishing in its goroutine when Stop gave
+// up waiting, and it uses the same chunker fields, so the new run waits
+// for it first. This is short as the old run is stopped and the stream
+// reads are cancelled, but a run stuck for good only holds up the
+// connect until ctx is done.
+//
+// With fallbacks each source is tried once, starting with the one last
+// used.
+func (chunker *Chunker) ConnectContext(ctx context.Context) error {
+	if chunker.done != nil {
+		select {
+		case <-chunker.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	chunker.ctx, chunker.stopRun = context.WithCancel(ctx)
+	err := chunker.connect()
+	for i := 1; err != nil && i < len(chunker.sources) && ctx.Err() == nil; i++ {
+		err = chunker.connect()
+	}
+	if err != nil {
+		chunker.stopRun()
+		chunker.setState(StateFailed)
+		return err
+	}
+
+	chunker.stop = make(chan struct{})
+	chunker.done = make(chan struct{})
+	return nil
+}
+
+// connect connects to the source in use. When that fails, the next
+// attempt goes to the next one of the fallbacks.
+func (chunker *Chunker) connect() error {
+	err := chunker.connectSource(chunker.sourceURL())
+	if err != nil && len(chunker.sources) > 1 {
+		next := (int(atomic.LoadInt32(&chunker.current)) + 1) % len(chunker.sources)
+		atomic.StoreInt32(&chunker.current, int32(next))
+		chunker.digestCh = nil // from another camera
+		chunker.resetClient()
+		chunker.log.Warn("switching source", "err", err, "next", chunker.sources[next].Redacted())
+	}
+	return err
+}
+
+// sourceURL returns the source in use. It is safe to call from any
+// goroutine.
+func (chunker *Chunker) sourceURL() *url.URL {
+	return chunker.sources[atomic.LoadInt32(&chunker.current)]
+}
+
+func (chunker *Chunker) connectSource(source *url.URL) error {
+	chunker.log.Info("connecting", "url", source.Redacted())
+
+	ctx, cancel := context.WithCancel(chunker.ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", source.String(), nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	chunker.cancel = cancel
+	connected := false
+	defer func() {
+		if !connected {
+			cancel()
+		}
+	}()
+
+	// a gzipped multipart body can't be split into frames, and the
+	// client would only decompress it transparently when asking itself
+	req.Header.Set("Accept-Encoding", "identity")
+
+	// custom headers go first, so the credentials take precedence over
+	// any Authorization given here
+	for key, value := range chunker.Headers {
+		if strings.EqualFold(key, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(key, value)
+	}
+
+	if chunker.digestCh != nil && chunker.credentials() {
+		req.Header.Set("Authorization", chunker.digestCh.authorize(
+			chunker.username, chunker.password, req.Method, req.URL.RequestURI()))
+	} else if chunker.basicAuthEnabled() {
+		req.SetBasicAuth(chunker.username, chunker.password)
+	}
+
+	client := chunker.httpClient()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if chunker.credentials() && digestAuthRequested(resp) {
+		chunker.discardResponse(resp)
+
+		// a new challenge, either the first one or the old nonce went stale
+		challenge, err := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			chunker.digestCh = nil
+			return err
+		}
+		chunker.digestCh = challenge
+
+		// authenticate for the URL that sent the challenge in case of redirects
+		req.Header.Set("Authorization", challenge.authorize(
+			chunker.username, chunker.password, req.Method, resp.Request.URL.RequestURI()))
+		resp, err = client.Do(req)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("request failed: %s", resp.Status)
+		chunker.keepResponse(resp, "", err)
+		chunker.discardResponse(resp)
+		return err
+	}
+
+	boundary, err := chunker.getBoundary(resp)
+	chunker.keepResponse(resp, boundary, err)
+	if err != nil {
+		chunker.discardResponse(resp)
+		return err
+	}
+
+	chunker.resp = resp
+	chunker.boundary = boundary
+	connected = true
+	atomic.StoreInt32(&chunker.connected, 1)
+	chunker.setState(StateConnected)
+	return nil
+}
+
+// SourceResponse describes the response of the source to a connect, as
+// far as the proxy got with it.
+type SourceResponse struct {
+	Time     time.Time   `json:"time"`
+	URL      string      `json:"url"` // after redirects, without the password
+	Status   string      `json:"status"`
+	Header   http.Header `json:"headers"`
+	Boundary string      `json:"boundary,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+func (chunker *Chunker) keepResponse(resp *http.Response, boundary string, err error) {
+	response := &SourceResponse{
+		Time:     time.Now(),
+		URL:      resp.Request.URL.Redacted(),
+		Status:   resp.Status,
+		Header:   resp.Header.Clone(),
+		Boundary: boundary,
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	chunker.responseMutex.Lock()
+	chunker.response = response
+	chunker.responseMutex.Unlock()
+}
+
+// LastResponse returns the source response of the last connect, also
+// when it failed or the stream is no longer connected, nil before the
+// first response. It is safe to call from any goroutine, the result must
+// not be changed.
+func (chunker *Chunker) LastResponse() *SourceResponse {
+	chunker.responseMutex.Lock()
+	defer chunker.responseMutex.Unlock()
+
+	return chunker.response
+}
+
+func (chunker *Chunker) setState(state string) {
+	if chunker.OnStateChange != nil {
+		chunker.OnStateChange(state)
+	}
+}
+
+func (chunker *Chunker) closeResponse(resp *http.Response) {
+	err := resp.Body.Close()
+	if err != nil {
+		chunker.log.Debug("body close failed", "err", err)
+	}
+}
+
+// maxDiscard is the most read from a rejected response so that its
+// connection can go back to the pool. Longer bodies, like a stream of
+// the wrong type, are closed with their connection.
+const maxDiscard = 4 << 10
+
+func (chunker *Chunker) discardResponse(resp *http.Response) {
+	io.CopyN(ioutil.Discard, resp.Body, maxDiscard)
+	chunker.closeResponse(resp)
+}
+
+// parseMediaType is a lenient fallback for Content-Type headers that
+// mime.ParseMediaType rejects, as some cameras send invalid parameters.
+func parseMediaType(contentType string) (string, map[string]string) {
+	mediaType := ""
+	params := make(map[string]string)
+	for i, s := range strings.Split(contentType, ";") {
+		part := strings.TrimSpace(s)
+		if i == 0 {
+			mediaType = part
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		k := kv[0]
+		v := ""
+		if len(kv) > 1 {
+			v = kv[1]
+		}
+		if len(v) > 1 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		params[k] = v
+	}
+	return mediaType, params
+}
+
+func (chunker *Chunker) getBoundary(resp *http.Response) (string, error) {
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = parseMediaType(contentType)
+		mediaType = strings.ToLower(mediaType)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return "", notMultipartError(resp, mediaType, contentType)
+	}
+
+	// the frames are split the same way whatever the subtype, so others
+	// are only refused in strict mode
+	if mediaType != "multipart/x-mixed-replace" {
+		if chunker.StrictMultipart {
+			return "", fmt.Errorf("%w: %s instead of multipart/x-mixed-replace", ErrNotMultipart, mediaType)
+		}
+		if !chunker.oddWarned {
+			chunker.log.Warn("unusual stream type", "type", mediaType)
+			chunker.oddWarned = true
+		}
+	}
+
+	boundary := params["boundary"]
+	if boundary == "" {
+		return "", fmt.Errorf("%w: %s", ErrNoBoundary, contentType)
+	}
+
+	return boundary, nil
+}
+
+// notMultipartError explains what the source sent instead of a stream,
+// which is usually a wrong URL: a snapshot page or a web interface.
+func notMultipartError(resp *http.Response, mediaType, contentType string) error {
+	head, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if mediaType == "" && len(head) > 0 {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return fmt.Errorf("source sent a single image, %w (Content-Type: %s)", ErrNotMultipart, contentType)
+	case mediaType == "text/html":
+		return fmt.Errorf("source sent an HTML page, %w (Content-Type: %s): %s",
+			ErrNotMultipart, contentType, snippet(head))
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json":
+		return fmt.Errorf("source sent %s, %w (Content-Type: %s): %s",
+			mediaType, ErrNotMultipart, contentType, snippet(head))
+	default:
+		return fmt.Errorf("unexpected media type, %w (Content-Type: %s)", ErrNotMultipart, contentType)
+	}
+}
+
+// snippet returns the start of a text body for error messages.
+func snippet(data []byte) string {
+	text := strings.Join(strings.Fields(string(data)), " ")
+	if len(text) > 120 {
+		text = text[:120] + "..."
+	}
+	return text
+}
+
+// detectBoundary checks the start of the body for sources that declare
+// the boundary together with the "--" delimiter prefix, for example
+// boundary=--myboundary followed by --myboundary lines in the body.
+// The multipart reader adds the prefix itself, so it is dropped then.
+func detectBoundary(r *bufio.Reader, boundary string) string {
+	if !strings.HasPrefix(boundary, "--") {
+		return boundary
+	}
+
+	dashed := "--" + boundary
+	data, _ := r.Peek(len(dashed) + 4) // room for a leading CRLF
+	line := bytes.TrimLeft(data, "\r\n")
+	if bytes.HasPrefix(line, []byte(dashed)) {
+		return boundary
+	}
+	if bytes.HasPrefix(line, []byte(boundary)) {
+		return strings.TrimPrefix(boundary, "--")
+	}
+
+	return boundary
+}
+
+// ID returns the name of the stream the chunker reads.
+func (chunker *Chunker) ID() string {
+	return chunker.id
+}
+
+// Source returns the URL of the source in use, without the password.
+// It is safe to call from any goroutine.
+func (chunker *Chunker) Source() string {
+	return chunker.sourceURL().Redacted()
+}
+
+func (chunker *Chunker) GetHeader() http.Header {
+	return chunker.resp.Header
+}
+
+// watchdog closes the stream when the source keeps the connection open
+// but stops sending frames, which would otherwise block the read forever.
+// The returned timer has to be reset after every frame.
+func (chunker *Chunker) watchdog(timeout time.Duration, body io.Closer, stalled *int32) *time.Timer {
+	cancel := chunker.cancel // the next connection replaces it
+	return time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(stalled, 1)
+		chunker.log.Warn("stream stalled", "timeout", timeout)
+		cancel()
+		body.Close()
+	})
+}
+
+// headerSize adds up the part headers as they were sent, give or take
+// the whitespace. A source that never ends the headers can't make them
+// grow without bound, the multipart reader stops at 10 MB or 10000
+// headers, but that is still far more than any camera sends.
+func headerSize(header textproto.MIMEHeader) int {
+	size := 0
+	for key, values := range header {
+		for _, value := range values {
+			size += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// exactReadMax caps the allocation made up front from a Content-Length
+// when there is no frame size limit.
+const exactReadMax = 32 << 20
+
+// readPart reads the frame data of a part, failing once it grows beyond
+// limit bytes. A limit of 0 disables the check. With a pooled buffer the
+// data is read into it, otherwise into a new allocation.
+func readPart(part *multipart.Part, limit int64, fb *frameBuffer) ([]byte, error) {
+	length := int64(-1)
+	if size := part.Header.Get("Content-Length"); size != "" {
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+		if err == nil && n >= 0 {
+			length = n
+		}
+	}
+	if limit > 0 && length > limit {
+		return nil, fmt.Errorf("frame too large: Content-Length %d exceeds limit of %d bytes", length, limit)
+	}
+
+	var r io.Reader = part
+	if limit > 0 {
+		r = io.LimitReader(part, limit+1)
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case fb != nil:
+		data, err = readPooled(r, &fb.buf, length)
+	case length > 0 && length <= exactReadMax:
+		data, err = readExact(r, length)
+	default:
+		data, err = ioutil.ReadAll(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, fmt.Errorf("frame too large: more than %d bytes", limit)
+	}
+
+	return data, nil
+}
+
+// readExact reads a part with a known Content-Length straight into a
+// buffer of that size. The part still ends at the boundary, so a wrong
+// Content-Length is not trusted: a longer part is appended to the
+// buffer, and a much shorter one is copied out of it, as the frame would
+// otherwise keep the whole buffer alive in every queue holding it.
+func readExact(r io.Reader, length int64) ([]byte, error) {
+	data := make([]byte, length)
+
+	// not io.ReadFull, it would hide the ErrUnexpectedEOF of a truncated
+	// stream behind the one for a short part
+	for n := 0; n < len(data); {
+		m, err := r.Read(data[n:])
+		n += m
+		if err == io.EOF && len(data)-n > n/8 {
+			return append([]byte(nil), data[:n]...), nil // far shorter than announced
+		}
+		if err == io.EOF {
+			return data[:n], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// usually only the end of the part is left
+	var probe [1]byte
+	n, err := io.ReadFull(r, probe[:])
+	if err == io.EOF {
+		return data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, probe[:n]...)
+	return append(data, rest...), nil
+}
+
+// readPooled reads a part into a buffer of the pool. A pooled buffer
+// keeps its size, so after the first frames it usually needs no growing.
+func readPooled(r io.Reader, buf *bytes.Buffer, length int64) ([]byte, error) {
+	if length > 0 && length <= exactReadMax {
+		buf.Grow(int(length) + bytes.MinRead) // the end is only noticed with room left
+	}
+
+	_, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// partContentType returns the media type of a part, without parameters.
+// The variants cameras use for JPEG, or none at all, all become
+// image/jpeg.
+func partContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "image/jpeg"
+	}
+
+	switch mediaType {
+	case "image/jpg", "image/pjpeg", "image/x-jpeg", "image/jpe", "jpeg", "jpg":
+		return "image/jpeg"
+	}
+	return mediaType
+}
+
+// looksLikeJPEG checks the frame starts with the JPEG SOI marker and ends
+// with EOI, ignoring any padding some cameras add after the image.
+func looksLikeJPEG(data []byte) bool {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	return len(data) >= 4 &&
+		data[0] == 0xFF && data[1] == 0xD8 &&
+		data[len(data)-2] == 0xFF && data[len(data)-1] == 0xD9
+}
+
+// Start reads the stream until it is stopped or fails for good, closing
+// pubChan at the end. The frames are only sent while the chunker runs,
+// so a stopped chunker never blocks on a pubChan nobody reads anymore.
+func (chunker *Chunker) Start(pubChan chan Frame) {
+	defer close(chunker.done)
+	defer close(pubChan)
+
+	for {
+		failure := chunker.readStream(pubChan)
+		if chunker.stopped() {
+			chunker.log.Info("stopped")
+			chunker.setState(StateStopped)
+			return
+		}
+		chunker.setState(StateDisconnected)
+
+		if failure != nil {
+			chunker.log.Warn("stream failed", "err", failure)
+		} else {
+			chunker.log.Warn("source closed the stream")
+		}
+
+		if !chunker.reconnect() {
+			if chunker.stopped() || chunker.ctx.Err() != nil {
+				chunker.setState(StateStopped)
+			} else {
+				chunker.setState(StateFailed)
+			}
+			return
+		}
+	}
+}
+
+// retryDelay is the wait between the retries of a chunker without a
+// Backoff, the same as the default base delay of the PubSub.
+const retryDelay = 500 * time.Millisecond
+
+// reconnect tries to connect to the source again after the stream was
+// lost, keeping the subscribers waiting on the same pubChan meanwhile.
+func (chunker *Chunker) reconnect() bool {
+	for attempt := 1; attempt <= chunker.MaxRetries; attempt++ {
+		delay := retryDelay
+		if chunker.Backoff != nil {
+			delay = chunker.Backoff.Next()
+		}
+		chunker.log.Warn("reconnecting", "delay", delay,
+			"attempt", attempt, "retries", chunker.MaxRetries)
+		chunker.setState(StateReconnecting)
+
+		select {
+		case <-time.After(delay):
+		case <-chunker.stop:
+			return false
+		case <-chunker.ctx.Done():
+			return false
+		}
+
+		err := chunker.connect()
+		if err == nil {
+			return true
+		}
+		chunker.log.Warn("reconnect failed", "err", err)
+	}
+
+	if chunker.MaxRetries > 0 {
+		chunker.log.Error("giving up", "attempts", chunker.MaxRetries)
+	}
+	return false
+}
+
+// readStream publishes the frames from the current connection until it
+// fails or the chunker is stopped.
+func (chunker *Chunker) readStream(pubChan chan Frame) error {
+	chunker.log.Info("started")
+
+	body := chunker.resp.Body
+	defer func() {
+		err := body.Close()
+		if err != nil {
+			chunker.log.Debug("body close failed", "err", err)
+		}
+	}()
+
+	chunker.freeze = freezeDetector{frames: chunker.FreezeFrames, window: chunker.FreezeTime}
+
+	var stalled int32
+	var prevFrame time.Time
+	var watchdog *time.Timer
+	frameTimeout := chunker.FrameTimeout
+	if frameTimeout > 0 {
+		watchdog = chunker.watchdog(frameTimeout, body, &stalled)
+	}
+
+	// The parts are delimited by scanning for the boundary, so sources
+	// that leave out the Content-Length of the parts work the same, as do
+	// chunked responses since the transfer encoding is handled by net/http.
+	var failure error
+	reader := bufio.NewReaderSize(body, chunker.ReadBuffer)
+	boundary := detectBoundary(reader, chunker.boundary)
+	if boundary != chunker.boundary {
+		chunker.log.Debug("boundary declared with leading dashes", "boundary", chunker.boundary)
+	}
+	var source io.Reader = reader
+	if needsHeaderFix(reader, boundary) {
+		chunker.log.Debug("adding missing empty line after part headers")
+		source = newHeaderFixer(reader, boundary)
+	}
+	mr := multipart.NewReader(source, boundary)
+
+	// the pooled buffer of the frame being read, released unless it was
+	// passed on
+	var pending *frameBuffer
+	defer func() { pending.release() }()
+
+	var ticker *time.Ticker
+	firstFrame := true
+	if chunker.rate > 0 {
+		interval := float64(time.Second) / chunker.rate
+		ticker = time.NewTicker(time.Duration(interval))
+	}
+
+ChunkLoop:
+	for {
+		pending.release() // a skipped frame
+		pending = nil
+
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break ChunkLoop
+		}
+		if err != nil {
+			failure = err
+			break ChunkLoop
+		}
+
+		if size := headerSize(part.Header); chunker.MaxHeaderSize > 0 && size > chunker.MaxHeaderSize {
+			failure = fmt.Errorf("part headers too large: %d bytes exceed limit of %d bytes",
+				size, chunker.MaxHeaderSize)
+			break ChunkLoop
+		}
+
+		if chunker.PooledRead {
+			pending = newFrameBuffer()
+		}
+		data, err := readPart(part, chunker.MaxFrameSize, pending)
+		if err != nil {
+			failure = err
+			break ChunkLoop
+		}
+
+		err = part.Close()
+		if err != nil {
+			failure = err
+			break ChunkLoop
+		}
+
+		if len(data) == 0 {
+			if chunker.AllowEmptyChunks {
+				// a keepalive, it does not count as a frame for the watchdog
+				chunker.log.Debug("skipping empty part")
+				continue ChunkLoop
+			}
+			failure = errors.New("received final chunk of size 0")
+			break ChunkLoop
+		}
+
+		now := time.Now()
+		if !prevFrame.IsZero() {
+			chunker.updateInterval(now.Sub(prevFrame))
+		}
+		prevFrame = now
+		atomic.StoreInt64(&chunker.lastFrame, now.UnixNano())
+		if watchdog != nil {
+			watchdog.Reset(frameTimeout)
+		}
+
+		if chunker.ValidateJPEG && !looksLikeJPEG(data) {
+			chunker.log.Debug("dropping frame that is not a JPEG image", "size", len(data))
+			continue ChunkLoop
+		}
+
+		frozen, recovered := chunker.freeze.check(data, time.Now())
+		if frozen {
+			chunker.log.Warn("stream appears frozen", "frames", chunker.freeze.count,
+				"duration", time.Since(chunker.freeze.since).Round(time.Second))
+			if chunker.FreezeReconnect {
+				failure = fmt.Errorf("source repeated the same frame %d times", chunker.freeze.count)
+				break ChunkLoop
+			}
+		} else if recovered {
+			chunker.log.Info("stream no longer frozen")
+		}
+
+		select { // check for stop
+		case <-chunker.stop:
+			break ChunkLoop
+		default:
+		}
+
+		if !firstFrame && ticker != nil {
+			select {
+			case <-ticker.C: // use frame
+			default: // skip frame
+				continue ChunkLoop
+			}
+		}
+
+		if firstFrame && chunker.Backoff != nil {
+			chunker.Backoff.Reset() // connection is delivering again
+		}
+
+		rawType := part.Header.Get("Content-Type")
+		frameType := partContentType(rawType)
+		if firstFrame && frameType != rawType {
+			chunker.log.Debug("normalized part content type",
+				"type", rawType, "normalized", frameType)
+		}
+		chunker.frameType.Store(frameType)
+
+		firstFrame = false
+		select {
+		case pubChan <- Frame{Data: data, Header: part.Header, buf: pending}:
+			pending = nil // released by the loop
+		case <-chunker.stop:
+			break ChunkLoop
+		}
+	}
+
+	if ticker != nil {
+		ticker.Stop()
+	}
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+	if atomic.LoadInt32(&stalled) == 1 {
+		failure = fmt.Errorf("no frame received for %s", frameTimeout)
+	}
+	chunker.cancel()
+	atomic.StoreInt32(&chunker.connected, 0)
+	atomic.StoreUint64(&chunker.interval, 0)
+
+	return failure
+}
+
+// Stop ends the run started by Connect and waits up to StopTimeout for
+// its goroutine to close the source connection, so stopping and
+// starting again quickly never leaves an old read going on.
+func (chunker *Chunker) Stop() {
+	chunker.wait(chunker.halt())
+}
+
+// halt tells the run to end without waiting for it, and returns the
+// channel closed once its goroutine is done.
+func (chunker *Chunker) halt() <-chan struct{} {
+	chunker.log.Info("stopping")
+	close(chunker.stop)
+	chunker.stopRun() // aborts a blocked read or a reconnect
+	return chunker.done
+}
+
+// wait waits up to StopTimeout for a halted run to end. It only reads
+// the settings of the chunker, so it can be called from any goroutine.
+func (chunker *Chunker) wait(done <-chan struct{}) {
+	if chunker.StopTimeout <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(chunker.StopTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		chunker.log.Warn("stream still closing", "timeout", chunker.StopTimeout)
+	}
+}
+
+// Connected reports whether the source stream is currently being read.
+// It is safe to call from any goroutine.
+func (chunker *Chunker) Connected() bool {
+	return atomic.LoadInt32(&chunker.connected) == 1
+}
+
+// ContentType returns the type of the frames read from the source,
+// image/jpeg until a frame arrives. It is safe to call from any
+// goroutine.
+func (chunker *Chunker) ContentType() string {
+	if frameType, ok := chunker.frameType.Load().(string); ok {
+		return frameType
+	}
+	return "image/jpeg"
+}
+
+// fpsSmoothing is the weight of the newest frame interval in the
+// average behind FPS.
+const fpsSmoothing = 0.1
+
+// updateInterval adds the time between two frames to the moving
+// average. Only the stream goroutine writes it.
+func (chunker *Chunker) updateInterval(interval time.Duration) {
+	avg := math.Float64frombits(atomic.LoadUint64(&chunker.interval))
+	if avg == 0 {
+		avg = float64(interval)
+	} else {
+		avg += fpsSmoothing * (float64(interval) - avg)
+	}
+	atomic.StoreUint64(&chunker.interval, math.Float64bits(avg))
+}
+
+// FPS returns the frame rate of the source, an exponential moving
+// average over the frames of the current connection. It is 0 until two
+// frames were read and while disconnected. It is safe to call from any
+// goroutine.
+func (chunker *Chunker) FPS() float64 {
+	avg := math.Float64frombits(atomic.LoadUint64(&chunker.interval))
+	if avg <= 0 {
+		return 0
+	}
+	return float64(time.Second) / avg
+}
+
+// LastFrame returns when the last frame was read from the source, zero
+// if none was yet. It is safe to call from any goroutine.
+func (chunker *Chunker) LastFrame() time.Time {
+	last := atomic.LoadInt64(&chunker.lastFrame)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+func (chunker *Chunker) stopped() bool {
+	select {
+	case <-chunker.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (chunker *Chunker) Started() bool {
+	if chunker.stop == nil { // Never started
+		return false
+	}
+
+	select {
+	case <-chunker.stop: // Already stopped
+		return false
+	default:
+		return true // Still running
+	}
+}
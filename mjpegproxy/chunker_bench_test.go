@@ -0,0 +1,98 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// frame4K is about the size of a 3840x2160 JPEG from a camera.
+const frame4K = 1500 << 10
+
+// BenchmarkReadStreams reads 4K frames from several streams at once,
+// like the chunkers of that many cameras, with and without -pooledread.
+func BenchmarkReadStreams(b *testing.B) {
+	const frames = 5
+
+	frame := make([]byte, frame4K)
+	var stream bytes.Buffer
+	for i := 0; i < frames; i++ {
+		stream.WriteString("--b\r\nContent-Type: image/jpeg\r\n\r\n")
+		stream.Write(frame)
+		stream.WriteString("\r\n")
+	}
+	stream.WriteString("--b--\r\n")
+
+	for _, streams := range []int{1, 8, 32} {
+		for _, pooled := range []bool{false, true} {
+			b.Run(fmt.Sprintf("streams=%d/pooled=%v", streams, pooled), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(streams * stream.Len()))
+
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				for i := 0; i < b.N; i++ {
+					var wg sync.WaitGroup
+					for s := 0; s < streams; s++ {
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							readTestStream(b, stream.Bytes(), pooled)
+						}()
+					}
+					wg.Wait()
+				}
+				runtime.ReadMemStats(&after)
+
+				perFrame := float64(after.TotalAlloc-before.TotalAlloc) / float64(b.N*streams*frames)
+				b.ReportMetric(perFrame, "B/frame")
+			})
+		}
+	}
+}
+
+func readTestStream(b *testing.B, stream []byte, pooled bool) {
+	mr := multipart.NewReader(bytes.NewReader(stream), "b")
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		var fb *frameBuffer
+		if pooled {
+			fb = newFrameBuffer()
+		}
+		if _, err := readPart(part, 8<<20, fb); err != nil {
+			b.Error(err)
+			return
+		}
+		fb.release() // written by all the clients
+	}
+}
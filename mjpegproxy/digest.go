@@ -0,0 +1,178 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// digestChallenge holds the parameters of a WWW-Authenticate: Digest
+// challenge. It is kept by the chunker between connections, so that the
+// reconnects can authenticate right away with the same nonce and the
+// next nonce count, until the source sends a fresh challenge.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       bool
+	nc        uint32
+}
+
+func digestAuthRequested(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized &&
+		strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), "Digest ")
+}
+
+// parseAuthParams splits the auth-param list of a challenge. Values may
+// be quoted strings, which can contain commas and escaped characters.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return params
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val strings.Builder
+		if strings.HasPrefix(s, `"`) {
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				val.WriteByte(s[i])
+			}
+			if i < len(s) {
+				i++ // closing quote
+			}
+			s = s[i:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val.WriteString(strings.TrimSpace(s[:end]))
+			s = s[end:]
+		}
+		params[key] = val.String()
+	}
+}
+
+func parseDigestChallenge(header string) (*digestChallenge, error) {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil, fmt.Errorf("not a digest challenge: %s", header)
+	}
+	params := parseAuthParams(strings.TrimPrefix(header, "Digest "))
+
+	challenge := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	if challenge.nonce == "" {
+		return nil, errors.New("digest challenge without nonce")
+	}
+
+	if qop, found := params["qop"]; found {
+		for _, v := range strings.Split(qop, ",") {
+			if strings.TrimSpace(v) == "auth" {
+				challenge.qop = true
+			}
+		}
+		if !challenge.qop {
+			return nil, fmt.Errorf("unsupported digest qop: %s", qop)
+		}
+	}
+
+	switch strings.ToUpper(challenge.algorithm) {
+	case "", "MD5", "MD5-SESS", "SHA-256", "SHA-256-SESS":
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", challenge.algorithm)
+	}
+
+	return challenge, nil
+}
+
+func (challenge *digestChallenge) hash(s string) string {
+	var h hash.Hash
+	if strings.HasPrefix(strings.ToUpper(challenge.algorithm), "SHA-256") {
+		h = sha256.New()
+	} else {
+		h = md5.New()
+	}
+	io.WriteString(h, s)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// authorize returns the Authorization header value for the next request,
+// advancing the nonce count.
+func (challenge *digestChallenge) authorize(username, password, method, uri string) string {
+	challenge.nc++
+	nc := fmt.Sprintf("%08x", challenge.nc)
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := fmt.Sprintf("%x", b)
+
+	h1 := challenge.hash(fmt.Sprintf("%s:%s:%s", username, challenge.realm, password))
+	if strings.HasSuffix(strings.ToUpper(challenge.algorithm), "-SESS") {
+		h1 = challenge.hash(fmt.Sprintf("%s:%s:%s", h1, challenge.nonce, cnonce))
+	}
+	h2 := challenge.hash(fmt.Sprintf("%s:%s", method, uri))
+
+	a := fmt.Sprintf("%s:%s:", h1, challenge.nonce)
+	if challenge.qop {
+		a += fmt.Sprintf("%s:%s:%s:", nc, cnonce, "auth")
+	}
+	a += h2
+	response := challenge.hash(a)
+
+	result := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		username, challenge.realm, challenge.nonce, uri, response)
+
+	algorithm := challenge.algorithm
+	if algorithm == "" {
+		algorithm = "MD5"
+	}
+	result += fmt.Sprintf(`, algorithm=%s`, algorithm)
+
+	if challenge.qop {
+		result += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, "auth", nc, cnonce)
+	}
+
+	if challenge.opaque != "" {
+		result += fmt.Sprintf(`, opaque="%s"`, challenge.opaque)
+	}
+
+	return result
+}
@@ -0,0 +1,139 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`realm="Camera, Inc", nonce="abc\"def", qop="auth,auth-int", stale=FALSE`)
+
+	want := map[string]string{
+		"realm": "Camera, Inc",
+		"nonce": `abc"def`,
+		"qop":   "auth,auth-int",
+		"stale": "FALSE",
+	}
+	for key, val := range want {
+		if params[key] != val {
+			t.Errorf("%s = %q, want %q", key, params[key], val)
+		}
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		err    bool
+	}{
+		{`Digest realm="cam", nonce="n", qop="auth"`, false},
+		{`Digest realm="cam", nonce="n", qop="auth-int, auth", algorithm=SHA-256`, false},
+		{`Digest realm="cam", nonce="n"`, false},
+		{`Digest realm="cam"`, true},
+		{`Digest realm="cam", nonce="n", qop="auth-int"`, true},
+		{`Digest realm="cam", nonce="n", algorithm=SHA-512`, true},
+		{`Basic realm="cam"`, true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseDigestChallenge(tt.header)
+		if (err != nil) != tt.err {
+			t.Errorf("parseDigestChallenge(%q) error = %v", tt.header, err)
+		}
+	}
+}
+
+func md5hex(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+// digestServer requires MD5 digest authentication with qop=auth and
+// records the nonce counts it has seen.
+type digestServer struct {
+	mutex      sync.Mutex
+	challenges int
+	counts     []string
+}
+
+func (ds *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	params := parseAuthParams(strings.TrimPrefix(r.Header.Get("Authorization"), "Digest "))
+	h1 := md5hex("user:cam:secret")
+	h2 := md5hex(r.Method + ":" + params["uri"])
+	want := md5hex(fmt.Sprintf("%s:nonce:%s:%s:auth:%s", h1, params["nc"], params["cnonce"], h2))
+
+	if params["response"] != want || params["uri"] != r.URL.RequestURI() {
+		ds.challenges++
+		w.Header().Set("WWW-Authenticate", `Digest realm="cam", nonce="nonce", qop="auth"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	ds.counts = append(ds.counts, params["nc"])
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+	fmt.Fprintf(w, "--b\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--b--\r\n", testFrames[0])
+}
+
+func TestDigestAuth(t *testing.T) {
+	ds := new(digestServer)
+	server := httptest.NewServer(ds)
+	defer server.Close()
+
+	chunker, err := NewSourceChunker(server.URL+"/video?resolution=640x480", WithDigestAuth("user", "secret"))
+	if err != nil {
+		t.Fatalf("NewSourceChunker: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if frames := readFrames(t, chunker); len(frames) != 1 {
+			t.Fatalf("connection %d: got %d frames", i, len(frames))
+		}
+	}
+
+	if ds.challenges != 1 {
+		t.Errorf("got %d challenges, want the challenge reused", ds.challenges)
+	}
+	want := []string{"00000001", "00000002", "00000003"}
+	if strings.Join(ds.counts, " ") != strings.Join(want, " ") {
+		t.Errorf("nonce counts = %v, want %v", ds.counts, want)
+	}
+}
+
+func TestDigestWrongPassword(t *testing.T) {
+	server := httptest.NewServer(new(digestServer))
+	defer server.Close()
+
+	chunker, err := NewSourceChunker(server.URL, WithDigestAuth("user", "wrong"))
+	if err != nil {
+		t.Fatalf("NewSourceChunker: %s", err)
+	}
+	if err := chunker.Connect(); err == nil {
+		t.Fatal("Connect succeeded with a wrong password")
+	}
+}
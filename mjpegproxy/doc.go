@@ -0,0 +1,43 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+/*
+Package mjpegproxy republishes MJPEG HTTP streams, so that many clients
+can watch a camera that only copes with a few connections.
+
+A Chunker reads the frames of a source and a PubSub fans them out to the
+subscribers. The PubSub is an http.Handler serving the stream, with
+ServeSnapshot, ServeWebSocket and ServeEvents for the other endpoints:
+
+	chunker, err := mjpegproxy.NewSourceChunker("http://camera/mjpg",
+		mjpegproxy.WithName("cam"), mjpegproxy.WithBasicAuth("user", "secret"))
+	if err != nil {
+		return err
+	}
+	pubSub := mjpegproxy.NewPubSub("cam", "/cam", chunker, nil)
+	pubSub.StopDelay = time.Minute
+	if err := pubSub.Start(); err != nil {
+		return err
+	}
+	mux.Handle("/cam", pubSub)
+
+The source is only connected while there are subscribers, unless the
+stream is Eager.
+*/
+package mjpegproxy
@@ -0,0 +1,168 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ServeEvents sends the frames as Server-Sent Events, for environments
+// that only let SSE through. Each event carries one base64 encoded JPEG
+// image in its data line.
+func (pubSub *PubSub) ServeEvents(w http.ResponseWriter, r *http.Request) {
+	if pubSub.Access.HandleCORS(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !pubSub.Access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !pubSub.Access.RequireAuth(w, r) {
+		return
+	}
+
+	if !pubSub.Access.RefererAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	interval := sendInterval(r.FormValue("fps"), pubSub.MaxFPS)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		pubSub.serverLog.Error("client could not be flushed", "client", r.RemoteAddr)
+		return
+	}
+
+	// limit connections coming from a single client
+	client := pubSub.Access.ClientAddress(r)
+	log := pubSub.serverLog.With("client", client)
+	if pubSub.MaxClientsPerIP > 0 {
+		ip := clientIP(client)
+		if !pubSub.acquireClient(ip) {
+			log.Info("client over connection limit", "limit", pubSub.MaxClientsPerIP)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer pubSub.releaseClient(ip)
+	}
+
+	sub := NewSubscriber(client, pubSub.ClientBuffer)
+	sub.interval = interval
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	defer func() {
+		log.Info("session ended", "path", r.URL.Path, "events", true,
+			"frames", atomic.LoadInt64(&sub.Frames), "bytes", atomic.LoadInt64(&sub.Bytes),
+			"duration", time.Since(sub.Started).Round(time.Millisecond))
+	}()
+
+	var sessionEnd <-chan time.Time
+	if pubSub.MaxSession > 0 {
+		timer := time.NewTimer(pubSub.MaxSession)
+		defer timer.Stop()
+		sessionEnd = timer.C
+	}
+
+	out := bufio.NewWriter(countingWriter{pubSub.limitWriter(w, r.Context()), &sub.Bytes})
+	headersSent := false
+
+	for {
+		var frame Frame
+		select {
+		case frame, ok = <-sub.ChunkChannel:
+		case <-r.Context().Done():
+			return
+		case <-sessionEnd:
+			log.Info("session time limit reached", "limit", pubSub.MaxSession)
+			return
+		}
+
+		if !ok {
+			if headersSent {
+				return // the client reconnects by itself
+			}
+			serveFailure(w, log, sub.err)
+			return
+		}
+
+		if !headersSent {
+			header := w.Header()
+			header.Set("Content-Type", "text/event-stream")
+			header.Set("Cache-Control", "no-cache")
+			pubSub.setResponseHeaders(header)
+			w.WriteHeader(http.StatusOK)
+			headersSent = true
+		}
+
+		err := writeEvent(out, frame.Data)
+		if err == nil {
+			err = out.Flush()
+		}
+		frame.Release()
+		if err != nil {
+			log.Debug("event write failed", "err", err)
+			sub.writeFailed = true
+			return
+		}
+		flusher.Flush()
+		atomic.AddInt64(&sub.Frames, 1)
+	}
+}
+
+// writeEvent writes a frame as a single event. Base64 has no line
+// breaks, so the image fits on one data line.
+func writeEvent(w io.Writer, data []byte) error {
+	_, err := io.WriteString(w, "data: ")
+	if err != nil {
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	_, err = enc.Write(data)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n\n")
+	return err
+}
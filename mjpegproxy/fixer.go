@@ -0,0 +1,127 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"bytes"
+)
+
+// jpegSOI is the start of image marker every JPEG frame begins with.
+var jpegSOI = []byte{0xFF, 0xD8}
+
+// needsHeaderFix looks at the first part of the stream for sources that
+// start the JPEG data right after the last part header, leaving out the
+// empty line that should end the headers. It only waits for more data
+// while the headers of the first part are incomplete.
+func needsHeaderFix(r *bufio.Reader, boundary string) bool {
+	for {
+		data, _ := r.Peek(r.Buffered())
+		if fix, decided := scanFirstPart(data, boundary); decided {
+			return fix
+		}
+
+		if r.Buffered() >= 512 {
+			return false
+		}
+		if _, err := r.Peek(r.Buffered() + 1); err != nil {
+			return false
+		}
+	}
+}
+
+func scanFirstPart(data []byte, boundary string) (fix, decided bool) {
+	delimiter := []byte("--" + boundary)
+
+	inHeaders := false
+	for len(data) > 0 {
+		line := data
+		complete := false
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+			complete = true
+		}
+		data = data[len(line):]
+
+		switch {
+		case inHeaders && bytes.HasPrefix(line, jpegSOI):
+			return true, true
+		case !complete:
+			return false, false // wait for the rest of the line
+		case bytes.HasPrefix(line, delimiter):
+			inHeaders = true
+		case inHeaders && len(bytes.TrimRight(line, "\r\n")) == 0:
+			return false, true
+		}
+	}
+
+	return false, false
+}
+
+// headerFixer adds the missing empty line between the part headers and
+// the JPEG data, so that the multipart reader can parse such sources.
+// Only the line starts are checked, the rest is passed through as is.
+type headerFixer struct {
+	r         *bufio.Reader
+	delimiter []byte
+	inHeaders bool
+	lineStart bool
+	pending   []byte
+	err       error
+}
+
+func newHeaderFixer(r *bufio.Reader, boundary string) *headerFixer {
+	return &headerFixer{
+		r:         r,
+		delimiter: []byte("--" + boundary),
+		lineStart: true,
+	}
+}
+
+func (f *headerFixer) Read(p []byte) (int, error) {
+	if len(f.pending) == 0 && f.err == nil {
+		line, err := f.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			f.err = err
+		}
+
+		if f.lineStart {
+			switch {
+			case bytes.HasPrefix(line, f.delimiter):
+				f.inHeaders = true
+			case !f.inHeaders:
+			case bytes.HasPrefix(line, jpegSOI):
+				f.inHeaders = false
+				line = append([]byte("\r\n"), line...)
+			case len(bytes.TrimRight(line, "\r\n")) == 0:
+				f.inHeaders = false
+			}
+		}
+		f.lineStart = err == nil
+		f.pending = line
+	}
+
+	n := copy(p, f.pending)
+	f.pending = f.pending[n:]
+	if len(f.pending) == 0 && f.err != nil {
+		return n, f.err
+	}
+	return n, nil
+}
@@ -0,0 +1,94 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+/* With PooledRead the chunker reads the frames into buffers taken from
+   framePool instead of allocating each one. The same frame is passed to
+   every subscriber, kept as the cached frame and handed to snapshots, so
+   the buffer is reference counted: each holder takes a reference and
+   releases it when done, and the last one puts the buffer back into the
+   pool. The loop takes the references for the queues and the cache, the
+   receivers release theirs once the frame is written.
+
+   A frame that is never released is left to the garbage collector, so a
+   holder that forgets it only costs the reuse. Releasing one too often
+   would hand out a buffer still in use, which is why that panics.
+*/
+
+// frameBuffer holds the data of a pooled frame.
+type frameBuffer struct {
+	buf  bytes.Buffer
+	refs int32
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return new(frameBuffer)
+	},
+}
+
+// newFrameBuffer takes an empty buffer from the pool, referenced once by
+// the caller.
+func newFrameBuffer() *frameBuffer {
+	fb := framePool.Get().(*frameBuffer)
+	fb.buf.Reset()
+	fb.refs = 1
+	return fb
+}
+
+func (fb *frameBuffer) retain() {
+	if fb != nil {
+		atomic.AddInt32(&fb.refs, 1)
+	}
+}
+
+func (fb *frameBuffer) release() {
+	if fb == nil {
+		return
+	}
+
+	refs := atomic.AddInt32(&fb.refs, -1)
+	if refs < 0 {
+		panic("mjpegproxy: frame released more often than received")
+	}
+	if refs == 0 {
+		framePool.Put(fb)
+	}
+}
+
+// Release tells the frame is no longer used, so its buffer can be reused
+// for another frame once every receiver is done with it. Data must not
+// be used after. Call it at most once for each frame received. Frames not
+// read with PooledRead have nothing to release, and frames never
+// released are simply garbage collected.
+func (frame Frame) Release() {
+	frame.buf.release()
+}
+
+// retain takes another reference to the frame, released on its own.
+func (frame Frame) retain() {
+	frame.buf.retain()
+}
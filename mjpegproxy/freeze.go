@@ -0,0 +1,69 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"time"
+)
+
+/* A hung camera often keeps sending the very same JPEG over and over. A
+   frame only counts as frozen once the identical frame was received both
+   for the given number of frames and for the given time, so neither a
+   fast source repeating a frame for a moment nor a slow one sending a
+   few frames of a static scene trips it. A static scene still differs in
+   the sensor noise of every frame, the hash only matches byte equal
+   frames.
+*/
+
+type freezeDetector struct {
+	frames int           // identical frames needed, 0 disables the check
+	window time.Duration // time the frame must stay identical
+
+	hash   uint64
+	count  int
+	since  time.Time
+	frozen bool
+}
+
+// check records a frame received at now and returns whether the stream
+// just became frozen with it. recovered reports when the first differing
+// frame arrives after the stream was frozen.
+func (fd *freezeDetector) check(data []byte, now time.Time) (frozen, recovered bool) {
+	if fd.frames <= 0 {
+		return false, false
+	}
+
+	hash := frameHash(data)
+	if fd.count == 0 || hash != fd.hash {
+		recovered = fd.frozen
+		fd.hash = hash
+		fd.count = 1
+		fd.since = now
+		fd.frozen = false
+		return false, recovered
+	}
+
+	fd.count++
+	if !fd.frozen && fd.count >= fd.frames && now.Sub(fd.since) >= fd.window {
+		fd.frozen = true
+		return true, false
+	}
+	return false, false
+}
@@ -0,0 +1,108 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Health answers the liveness and readiness probes. The process is live
+// as long as it serves requests, while it is ready only when every stream
+// is connected to its source and receiving frames.
+type Health struct {
+	pubSubs []*PubSub
+	maxAge  time.Duration
+}
+
+type healthStream struct {
+	Stream string `json:"stream"`
+	Reason string `json:"reason"`
+}
+
+type healthStatus struct {
+	Status  string         `json:"status"`
+	Streams []healthStream `json:"streams,omitempty"`
+}
+
+func NewHealth(pubSubs []*PubSub, maxAge time.Duration) *Health {
+	health := new(Health)
+
+	health.pubSubs = pubSubs
+	health.maxAge = maxAge
+
+	return health
+}
+
+// sourceReady tells why the chunker is not delivering, empty if it is.
+func sourceReady(chunker *Chunker, maxAge time.Duration) string {
+	if !chunker.Connected() {
+		return "source not connected"
+	}
+
+	last := chunker.LastFrame()
+	if last.IsZero() {
+		return "no frame received yet"
+	}
+	if age := time.Since(last); maxAge > 0 && age > maxAge {
+		return fmt.Sprintf("no frame for %s", age.Round(time.Second))
+	}
+
+	return ""
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(code)
+
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		logger.Debug("write failed", "component", "health", "err", err)
+	}
+}
+
+func (health *Health) ServeLive(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+func (health *Health) ServeReady(w http.ResponseWriter, r *http.Request) {
+	var failed []healthStream
+	for _, pubSub := range health.pubSubs {
+		reason := sourceReady(pubSub.chunker, health.maxAge)
+		if reason != "" && pubSub.standby != nil {
+			if sourceReady(pubSub.standby, health.maxAge) == "" {
+				reason = "" // subscribers can fail over
+			}
+		}
+		if reason != "" {
+			failed = append(failed, healthStream{Stream: pubSub.id, Reason: reason})
+		}
+	}
+
+	if len(failed) > 0 {
+		writeHealth(w, http.StatusServiceUnavailable, healthStatus{Status: "not ready", Streams: failed})
+		return
+	}
+
+	writeHealth(w, http.StatusOK, healthStatus{Status: "ok"})
+}
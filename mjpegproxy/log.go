@@ -0,0 +1,35 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"log/slog"
+)
+
+// logger is used by the chunkers, pubsubs and handlers of the package,
+// which derive their own loggers with the stream name.
+var logger = slog.Default()
+
+// SetLogger replaces the logger of the package. Chunkers and pubsubs
+// keep the logger they were created with, so it is best called before
+// creating them.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
@@ -0,0 +1,102 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Metrics renders the stream counters in the Prometheus text format.
+type Metrics struct {
+	pubSubs []*PubSub
+}
+
+func NewMetrics(pubSubs []*PubSub) *Metrics {
+	metrics := new(Metrics)
+
+	metrics.pubSubs = pubSubs
+
+	return metrics
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func streamLabels(pubSub *PubSub) string {
+	return fmt.Sprintf(`stream="%s",path="%s"`,
+		labelEscaper.Replace(pubSub.id), labelEscaper.Replace(pubSub.path))
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(pubSub *PubSub, stats StatsSnapshot) string
+}
+
+var metricList = []metric{
+	{"mjpeg_proxy_frames_total", "counter", "Frames published to subscribers.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.Frames) }},
+	{"mjpeg_proxy_bytes_total", "counter", "Bytes of frames published to subscribers.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.Bytes) }},
+	{"mjpeg_proxy_dropped_frames_total", "counter", "Frames not sent to slow subscribers.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.Dropped) }},
+	{"mjpeg_proxy_throttled_frames_total", "counter", "Frames skipped to lower the output frame rate.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.Throttled) }},
+	{"mjpeg_proxy_mass_disconnects_total", "counter", "Times all subscribers failed together.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.MassDisconnects) }},
+	{"mjpeg_proxy_subscribers", "gauge", "Current number of subscribers.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(s.Subscribers) }},
+	{"mjpeg_proxy_source_connected", "gauge", "Whether the source stream is connected.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(boolValue(p.chunker.Connected())) }},
+	{"mjpeg_proxy_source_fps", "gauge", "Frame rate of the source, averaged over recent frames.",
+		func(p *PubSub, s StatsSnapshot) string { return fmt.Sprint(p.chunker.FPS()) }},
+}
+
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snapshots := make([]StatsSnapshot, len(metrics.pubSubs))
+	for i, pubSub := range metrics.pubSubs {
+		snapshots[i] = pubSub.stats.Snapshot()
+	}
+
+	var buf bytes.Buffer
+	for _, m := range metricList {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", m.name, m.kind)
+		for i, pubSub := range metrics.pubSubs {
+			fmt.Fprintf(&buf, "%s{%s} %s\n", m.name, streamLabels(pubSub), m.value(pubSub, snapshots[i]))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		logger.Debug("write failed", "component", "metrics", "err", err)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewNegotiator returns a handler serving the stream or a snapshot from
+// the same URL, depending on the Accept header of the request. Only
+// clients asking for image/jpeg alone get a snapshot, anything
+// ambiguous like */* keeps getting the stream.
+func NewNegotiator(pubSub *PubSub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		if wantsSnapshot(r.Header.Get("Accept")) {
+			pubSub.ServeSnapshot(w, r)
+		} else {
+			pubSub.ServeHTTP(w, r)
+		}
+	})
+}
+
+// wantsSnapshot checks if the Accept header lists image/jpeg without
+// also accepting the multipart stream.
+func wantsSnapshot(accept string) bool {
+	jpeg := false
+
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		accepted := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err == nil && q <= 0 {
+					accepted = false
+				}
+			}
+		}
+		if !accepted {
+			continue
+		}
+
+		switch mediaType {
+		case "image/jpeg":
+			jpeg = true
+		case "multipart/x-mixed-replace", "multipart/*", "*/*":
+			return false
+		}
+	}
+
+	return jpeg
+}
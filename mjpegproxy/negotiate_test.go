@@ -0,0 +1,93 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWantsSnapshot(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"image/jpeg", true},
+		{"Image/JPEG", true},
+		{"image/jpeg;q=0.9", true},
+		{"image/jpeg, image/png", true},
+		{"image/jpeg, */*;q=0.1", false},
+		{"multipart/x-mixed-replace", false},
+		{"multipart/x-mixed-replace, image/jpeg", false},
+		{"image/jpeg, multipart/*", false},
+		{"image/jpeg;q=0", false},
+		{"image/jpeg, */*;q=0", true},
+		// browsers loading an <img>
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", false},
+	}
+
+	for _, test := range tests {
+		if got := wantsSnapshot(test.accept); got != test.want {
+			t.Errorf("wantsSnapshot(%q) = %v, want %v", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestNegotiator(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.SnapshotTimeout = 5 * time.Second
+	pubSub.MaxSession = 200 * time.Millisecond
+	handler := NewNegotiator(pubSub)
+
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"image/jpeg", "image/jpeg"},
+		{"multipart/x-mixed-replace", "multipart/x-mixed-replace"},
+		{"*/*", "multipart/x-mixed-replace"},
+		{"", "multipart/x-mixed-replace"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/test", nil)
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Accept %q: status %d", test.accept, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, test.contentType) {
+			t.Errorf("Accept %q: Content-Type %q, want %s", test.accept, ct, test.contentType)
+		}
+		if vary := w.Header().Get("Vary"); vary != "Accept" {
+			t.Errorf("Accept %q: Vary %q", test.accept, vary)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+// partHeaderRules pick the source part headers passed on to the stream
+// clients, see Options.PartHeaders. A nil value passes none of them.
+type partHeaderRules struct {
+	all  bool              // pass all the source headers
+	pass []string          // or just these
+	drop []string          // remove these
+	set  map[string]string // and set these on every part
+}
+
+// parsePartHeaders compiles the rules: "Name" passes the source header
+// on, "*" all of them, "Name:" removes it and "Name: value" sets it.
+func parsePartHeaders(rules []string) (*partHeaderRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	compiled := new(partHeaderRules)
+	compiled.set = make(map[string]string)
+
+	for _, rule := range rules {
+		kv := strings.SplitN(rule, ":", 2)
+		name := strings.TrimSpace(kv[0])
+		if name == "*" && len(kv) == 1 {
+			compiled.all = true
+			continue
+		}
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return nil, fmt.Errorf("invalid part header rule: %s", rule)
+		}
+
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		switch name {
+		case "Content-Type", "Content-Length", "X-Frame-Sequence":
+			return nil, fmt.Errorf("part header %s is set by the proxy", name)
+		}
+
+		switch {
+		case len(kv) == 1:
+			compiled.pass = append(compiled.pass, name)
+		case strings.TrimSpace(kv[1]) == "":
+			compiled.drop = append(compiled.drop, name)
+		case strings.ContainsAny(kv[1], "\r\n"):
+			return nil, fmt.Errorf("invalid part header rule: %s", rule)
+		default:
+			compiled.set[name] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return compiled, nil
+}
+
+// apply returns the headers to add to a part from the source header.
+// The proxy writes Content-Type and Content-Length itself, as the frames
+// are framed anew, so these are never passed on.
+func (rules *partHeaderRules) apply(source textproto.MIMEHeader) textproto.MIMEHeader {
+	if rules == nil {
+		return nil
+	}
+
+	header := make(textproto.MIMEHeader)
+	if rules.all {
+		for name, values := range source {
+			header[name] = values
+		}
+	}
+	for _, name := range rules.pass {
+		if values, ok := source[name]; ok {
+			header[name] = values
+		}
+	}
+	for _, name := range rules.drop {
+		delete(header, name)
+	}
+	for name, value := range rules.set {
+		header.Set(name, value)
+	}
+
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	header.Del("X-Frame-Sequence")
+
+	return header
+}
@@ -0,0 +1,64 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestParsePartHeaders(t *testing.T) {
+	source := textproto.MIMEHeader{
+		"Content-Type":   {"image/jpeg"},
+		"Content-Length": {"1234"},
+		"X-Timestamp":    {"1700000000"},
+		"X-Vendor":       {"acme"},
+	}
+
+	tests := []struct {
+		rules []string
+		want  textproto.MIMEHeader
+	}{
+		{nil, nil},
+		{[]string{"x-timestamp"}, textproto.MIMEHeader{"X-Timestamp": {"1700000000"}}},
+		{[]string{"*", "X-Vendor:"}, textproto.MIMEHeader{"X-Timestamp": {"1700000000"}}},
+		{[]string{"X-Camera: lobby", "X-Missing"}, textproto.MIMEHeader{"X-Camera": {"lobby"}}},
+		{[]string{"*", "X-Vendor: proxy"}, textproto.MIMEHeader{
+			"X-Timestamp": {"1700000000"}, "X-Vendor": {"proxy"}}},
+	}
+
+	for _, test := range tests {
+		rules, err := parsePartHeaders(test.rules)
+		if err != nil {
+			t.Errorf("%q: %s", test.rules, err)
+			continue
+		}
+		if got := rules.apply(source); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.rules, got, test.want)
+		}
+	}
+
+	for _, rule := range []string{"", ": value", "Bad Name", "Content-Length: 1", "content-type", "X-Frame-Sequence:"} {
+		if _, err := parsePartHeaders([]string{rule}); err == nil {
+			t.Errorf("%q: accepted", rule)
+		}
+	}
+}
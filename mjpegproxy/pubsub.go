@@ -0,0 +1,1214 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errStreamFailed = errors.New("stream failed")
+	errFrameTimeout = errors.New("frame timeout")
+
+	errTooManySubscribers = errors.New("too many subscribers")
+)
+
+// connectError marks the subscribers that were dropped because the
+// source could not be connected, as opposed to a stream that ended.
+type connectError struct {
+	err error
+}
+
+func (e connectError) Error() string {
+	return "connect failed: " + e.err.Error()
+}
+
+func (e connectError) Unwrap() error {
+	return e.err
+}
+
+// serveFailure answers a client whose subscription ended before the
+// first frame. The error itself is only logged, since it can include
+// the source URL.
+func serveFailure(w http.ResponseWriter, log *slog.Logger, err error) {
+	var connectErr connectError
+	switch {
+	case err == errTooManySubscribers:
+		http.Error(w, "Too many viewers, try again later", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrNotMultipart):
+		log.Warn("source is not a stream")
+		http.Error(w, "Source is not an MJPEG stream", http.StatusBadGateway)
+	case errors.As(err, &connectErr):
+		log.Warn("source connect failed")
+		http.Error(w, "Source connection failed", http.StatusBadGateway)
+	default:
+		log.Warn("stream failed")
+		http.Error(w, "Stream failed", http.StatusServiceUnavailable)
+	}
+}
+
+// minimum number of subscribers failing together to report a mass disconnect
+const massDisconnectMin = 2
+
+// what to drop when the queue of a subscriber is full
+const (
+	DropNew = "drop-new" // keep the queued frames, skip the new one
+	DropOld = "drop-old" // replace the oldest queued frame with the new one
+)
+
+// validBoundary checks the boundary is usable for the multipart
+// responses.
+func validBoundary(boundary string) error {
+	if boundary == "" {
+		return nil
+	}
+	err := multipart.NewWriter(io.Discard).SetBoundary(boundary)
+	if err != nil {
+		return fmt.Errorf("boundary %s: %s", boundary, err)
+	}
+	return nil
+}
+
+func validDropPolicy(policy string) error {
+	if policy != "" && policy != DropNew && policy != DropOld {
+		return fmt.Errorf("unknown drop policy: %s (valid: %s, %s)", policy, DropNew, DropOld)
+	}
+	return nil
+}
+
+// Frame is a JPEG image as read from the source and handed to the
+// subscribers. The subscribers share it, so Data is read-only.
+type Frame struct {
+	Data   []byte
+	Seq    uint64               // position in the published stream, counting from 1
+	Header textproto.MIMEHeader // of the source part, then the one passed on, see PartHeaders
+
+	buf *frameBuffer // holding Data for a pooled frame, nil otherwise
+}
+
+type Subscriber struct {
+	RemoteAddr   string
+	ChunkChannel chan Frame
+	Dropped      int64 // frames skipped while the client was busy
+	Frames       int64 // frames written to the client
+	Bytes        int64 // bytes written to the client
+	Started      time.Time
+	writeFailed  bool
+	err          error // why the channel was closed, set before closing
+
+	interval time.Duration // shortest time between frames, 0 for all frames
+	lastSent time.Time
+}
+
+// Options holds the settings for serving a stream to the clients. The
+// zero value serves every frame to any number of clients.
+type Options struct {
+	MaxSubscribers  int     // clients of the stream, 0 for no limit
+	MaxClientsPerIP int     // connections from one address, 0 for no limit
+	ClientBuffer    int     // frames queued for each client, at least 1
+	WriteBuffer     int     // collect the writes of a frame, 0 to write directly
+	DropPolicy      string  // DropNew or DropOld
+	DropWarn        int64   // warn each time a client misses this many frames
+	Boundary        string  // multipart boundary for the clients, random if empty
+	ClientCompat    bool    // frame the parts for legacy clients, see writeLegacyPart
+	FrameSeq        bool    // add X-Frame-Sequence to the part headers
+	MaxFPS          float64 // frame rate limit for each client, 0 for none
+	OutputFPS       float64 // frame rate published to all the clients, 0 for the source rate
+
+	// ResponseHeaders are set on the stream, snapshot and SSE responses,
+	// replacing the proxy's own; an empty value removes the header.
+	ResponseHeaders map[string]string
+
+	// PartHeaders are the rules for the part headers of the source that
+	// reach the stream clients, which otherwise only get Content-Type
+	// and Content-Length: "Name" passes the source header on, "*" all
+	// of them, "Name:" removes it and "Name: value" sets it.
+	PartHeaders []string
+
+	// TotalBandwidth, when set, limits the bytes sent to the stream
+	// clients together with all the other streams sharing it.
+	TotalBandwidth *Bandwidth
+
+	// OutputFPSCap, when set, returns a frame rate limit for all the
+	// clients, 0 for none. It is called for every frame and the lower of
+	// it and OutputFPS applies.
+	OutputFPSCap func() float64
+
+	FrameTimeout         time.Duration // age of the cached frame before it is dropped
+	StopDelay            time.Duration // source kept connected after the last client
+	SnapshotTimeout      time.Duration // wait for a frame for a snapshot
+	MaxSession           time.Duration // end client streams after this time, 0 for no limit
+	MassDisconnectWindow time.Duration // report clients failing together
+
+	// Eager streams keep the source connected without subscribers,
+	// reconnecting with the retry settings below.
+	Eager     bool
+	RetryBase time.Duration
+	RetryCap  time.Duration
+	Jitter    string
+
+	// optional timelapse of the cached frame, see archive.go
+	ArchiveDir      string
+	ArchiveInterval time.Duration
+
+	// Placeholder, when set, is a JPEG image sent to the clients every
+	// placeholderInterval while the source is reconnecting, like a "no
+	// signal" picture, instead of leaving them on the last frame.
+	Placeholder []byte
+}
+
+// placeholderInterval is how often the placeholder is sent while the
+// source is down, and how long the source has to be quiet first.
+const placeholderInterval = time.Second
+
+// PubSub fans the frames of a source out to the subscribers.
+//
+// Concurrency model: the subscribers map and the chunker lifecycle
+// fields (pubChan, stopTimer, onStandby, ...) belong to the loop
+// goroutine and must not be touched anywhere else, in particular not
+// from the HTTP handlers. Handlers talk to the loop through the
+// channels: subChan and unsubChan to join and leave, statusChan to get
+// a snapshot of the state for reporting, cycleChan to reconnect the
+// source. Connecting to the source runs in a goroutine of its own that
+// reports back on connectDone, so a slow source does not hold up the
+// loop. The few values that handlers read directly are guarded on
+// their own: stats uses atomics, the cached frame has frameMutex and
+// the per client counts clientsMutex.
+type PubSub struct {
+	id          string
+	path        string
+	chunker     *Chunker
+	cancel      context.CancelFunc
+	pubChan     chan Frame
+	connectDone chan error // result of the connect started by startChunker
+	subChan     chan *Subscriber
+	unsubChan   chan *Subscriber
+	statusChan  chan chan StreamStatus
+	cycleChan   chan chan error
+	subscribers map[*Subscriber]struct{}
+	stopTimer   *time.Timer
+	failStart   time.Time
+	failCount   int
+	stats       Stats
+	lastPublish time.Time
+	frameSeq    uint64           // frames published, only used by the loop
+	startTime   time.Time        // when the current source connection started
+	partHeaders *partHeaderRules // compiled from PartHeaders by Start
+
+	// the most recent frame, written by the loop and read by the handlers
+	frameMutex    sync.Mutex
+	lastFrame     Frame
+	lastFrameTime time.Time
+
+	// Options and Access are set before Start and not changed after.
+	Options
+	Access *Access
+
+	restartTimer *time.Timer
+	restartDelay *Backoff
+	archiving    int32
+
+	// the connect in progress, and whether it was cancelled meanwhile and
+	// should be followed by another one; Restart calls wait for it
+	connecting     bool
+	dropConnect    bool
+	startAgain     bool
+	restartReplies []chan error
+
+	standby     *Chunker
+	standbyChan chan Frame
+	standbyDown chan struct{}
+	standbyUp   int32
+	onStandby   bool
+
+	clientsMutex sync.Mutex
+	clients      map[string]int
+
+	log       *slog.Logger
+	serverLog *slog.Logger
+}
+
+// NewSubscriber creates a subscriber queueing up to depth frames. A deeper
+// queue rides out short stalls of the client without dropping frames, at
+// the cost of showing them later. At least one frame is always queued,
+// which leaves room for the cached frame sent on subscribe.
+func NewSubscriber(client string, depth int) *Subscriber {
+	sub := new(Subscriber)
+
+	if depth < 1 {
+		depth = 1
+	}
+
+	sub.RemoteAddr = client
+	sub.Started = time.Now()
+	sub.ChunkChannel = make(chan Frame, depth)
+
+	return sub
+}
+
+func NewPubSub(id, path string, chunker, standby *Chunker) *PubSub {
+	pubSub := new(PubSub)
+
+	pubSub.id = id
+	pubSub.path = path
+	pubSub.chunker = chunker
+	pubSub.standby = standby
+	pubSub.standbyChan = make(chan Frame)
+	pubSub.standbyDown = make(chan struct{})
+	pubSub.subChan = make(chan *Subscriber)
+	pubSub.unsubChan = make(chan *Subscriber)
+	pubSub.statusChan = make(chan chan StreamStatus)
+	pubSub.cycleChan = make(chan chan error)
+	pubSub.connectDone = make(chan error, 1)
+	pubSub.subscribers = make(map[*Subscriber]struct{})
+	pubSub.clients = make(map[string]int)
+	pubSub.log = logger.With("component", "pubsub", "stream", id)
+	pubSub.serverLog = logger.With("component", "server", "stream", id)
+	pubSub.stopTimer = time.NewTimer(0)
+	<-pubSub.stopTimer.C
+	pubSub.restartTimer = time.NewTimer(0)
+	<-pubSub.restartTimer.C
+
+	return pubSub
+}
+
+// newBackoff returns a backoff for the retries of the stream.
+func (pubSub *PubSub) newBackoff() (*Backoff, error) {
+	jitter := pubSub.Jitter
+	if jitter == "" {
+		jitter = "full"
+	}
+	base := pubSub.RetryBase
+	if base <= 0 {
+		base = 500 * time.Millisecond
+	}
+	return NewBackoff(base, pubSub.RetryCap, jitter)
+}
+
+// ID returns the name of the stream used in logs and metrics.
+func (pubSub *PubSub) ID() string {
+	return pubSub.id
+}
+
+// Path returns the serving path of the stream.
+func (pubSub *PubSub) Path() string {
+	return pubSub.path
+}
+
+// Chunker returns the chunker of the primary source.
+func (pubSub *PubSub) Chunker() *Chunker {
+	return pubSub.chunker
+}
+
+// Stats returns the counters of the stream.
+func (pubSub *PubSub) Stats() StatsSnapshot {
+	return pubSub.stats.Snapshot()
+}
+
+// Start runs the stream, after which the settings must not be changed.
+func (pubSub *PubSub) Start() error {
+	if err := validDropPolicy(pubSub.DropPolicy); err != nil {
+		return err
+	}
+	if err := validBoundary(pubSub.Boundary); err != nil {
+		return err
+	}
+	if pubSub.Placeholder != nil && !looksLikeJPEG(pubSub.Placeholder) {
+		return errors.New("placeholder is not a JPEG image")
+	}
+	partHeaders, err := parsePartHeaders(pubSub.PartHeaders)
+	if err != nil {
+		return err
+	}
+	pubSub.partHeaders = partHeaders
+	if pubSub.Eager {
+		pubSub.restartDelay, err = pubSub.newBackoff()
+		if err != nil {
+			return err
+		}
+	}
+
+	go pubSub.loop()
+
+	if pubSub.standby != nil {
+		go pubSub.keepStandby()
+	}
+
+	return nil
+}
+
+func (pubSub *PubSub) Subscribe(s *Subscriber) {
+	pubSub.subChan <- s
+}
+
+func (pubSub *PubSub) Unsubscribe(s *Subscriber) {
+	pubSub.unsubChan <- s
+}
+
+func (pubSub *PubSub) loop() {
+	if pubSub.Eager {
+		pubSub.startChunker()
+	}
+
+	var archiveTick <-chan time.Time
+	if pubSub.ArchiveDir != "" && pubSub.ArchiveInterval > 0 {
+		ticker := time.NewTicker(pubSub.ArchiveInterval)
+		defer ticker.Stop()
+		archiveTick = ticker.C
+	}
+
+	var placeholderTick <-chan time.Time
+	if pubSub.Placeholder != nil {
+		ticker := time.NewTicker(placeholderInterval)
+		defer ticker.Stop()
+		placeholderTick = ticker.C
+	}
+
+	for {
+		select {
+		case frame, ok := <-pubSub.pubChan:
+			if ok {
+				pubSub.doPublish(frame)
+			} else {
+				pubSub.stopChunker()
+				if !pubSub.failover() {
+					pubSub.stopSubscribers(nil)
+				}
+				if pubSub.Eager {
+					pubSub.scheduleRestart()
+				}
+			}
+
+		case frame := <-pubSub.standbyChan:
+			if pubSub.onStandby {
+				pubSub.doPublish(frame)
+			} else {
+				frame.Release()
+			}
+
+		case <-pubSub.standbyDown:
+			if pubSub.onStandby {
+				pubSub.onStandby = false
+				pubSub.setLastFrame(Frame{}, time.Time{})
+				pubSub.stopSubscribers(nil)
+			}
+
+		case sub := <-pubSub.subChan:
+			pubSub.doSubscribe(sub)
+
+		case sub := <-pubSub.unsubChan:
+			pubSub.doUnsubscribe(sub)
+
+		case reply := <-pubSub.statusChan:
+			reply <- pubSub.doStatus()
+
+		case reply := <-pubSub.cycleChan:
+			pubSub.doRestart(reply)
+
+		case err := <-pubSub.connectDone:
+			pubSub.connected(err)
+
+		case <-pubSub.restartTimer.C:
+			pubSub.startChunker()
+
+		case now := <-archiveTick:
+			pubSub.archive(now)
+
+		case now := <-placeholderTick:
+			pubSub.publishPlaceholder(now)
+
+		case <-pubSub.stopTimer.C:
+			if len(pubSub.subscribers) == 0 {
+				pubSub.stopChunker()
+				pubSub.onStandby = false
+			}
+		}
+	}
+}
+
+// doPublish caches the frame and queues it for the subscribers, which
+// take their own references to it. The one of the loop is released here.
+func (pubSub *PubSub) doPublish(frame Frame) {
+	defer frame.Release()
+
+	now := time.Now()
+	fpsCap := pubSub.OutputFPS
+	if pubSub.OutputFPSCap != nil {
+		if limit := pubSub.OutputFPSCap(); limit > 0 && (fpsCap == 0 || limit < fpsCap) {
+			fpsCap = limit
+		}
+	}
+	if fpsCap > 0 {
+		interval := time.Duration(float64(time.Second) / fpsCap)
+		if now.Sub(pubSub.lastPublish) < interval {
+			atomic.AddInt64(&pubSub.stats.throttled, 1)
+			return
+		}
+		// the source frames rarely fall on the interval, so keep to the
+		// rate on average instead of waiting a whole interval each time
+		if next := pubSub.lastPublish.Add(interval); now.Sub(next) < interval {
+			pubSub.lastPublish = next
+		} else {
+			pubSub.lastPublish = now
+		}
+	} else {
+		pubSub.lastPublish = now
+	}
+	pubSub.frameSeq++
+	frame.Seq = pubSub.frameSeq
+	frame.Header = pubSub.partHeaders.apply(frame.Header)
+	pubSub.setLastFrame(frame, now)
+
+	atomic.AddInt64(&pubSub.stats.frames, 1)
+	atomic.AddInt64(&pubSub.stats.bytes, int64(len(frame.Data)))
+
+	pubSub.send(frame, now)
+}
+
+// publishPlaceholder sends the placeholder to the clients of a source
+// that is reconnecting and sent nothing for a while. Real frames replace
+// it as soon as they come, and it is not counted as a source frame.
+func (pubSub *PubSub) publishPlaceholder(now time.Time) {
+	if pubSub.pubChan == nil || pubSub.onStandby || pubSub.chunker.Connected() {
+		return
+	}
+	if now.Sub(pubSub.chunker.LastFrame()) < placeholderInterval {
+		return
+	}
+
+	pubSub.frameSeq++
+	frame := Frame{Data: pubSub.Placeholder, Seq: pubSub.frameSeq}
+	frame.Header = pubSub.partHeaders.apply(nil)
+	pubSub.setLastFrame(frame, now)
+	pubSub.send(frame, now)
+}
+
+// send queues the frame for each subscriber within its frame rate.
+func (pubSub *PubSub) send(frame Frame, now time.Time) {
+	for s := range pubSub.subscribers {
+		if s.interval > 0 && now.Sub(s.lastSent) < s.interval {
+			continue // within the client frame rate, not a drop
+		}
+
+		frame.retain() // for the queue
+		select {
+		case s.ChunkChannel <- frame: // try to send
+			s.lastSent = now
+		default: // or drop a frame
+			if pubSub.DropPolicy == DropOld && replaceOldest(s, frame) {
+				s.lastSent = now
+			} else {
+				frame.Release()
+			}
+			atomic.AddInt64(&pubSub.stats.dropped, 1)
+			dropped := atomic.AddInt64(&s.Dropped, 1)
+			if pubSub.DropWarn > 0 && dropped%pubSub.DropWarn == 0 {
+				pubSub.log.Warn("subscriber is slow",
+					"client", s.RemoteAddr, "dropped", dropped)
+			}
+		}
+	}
+}
+
+// replaceOldest makes room for the new frame in a full queue, so slow
+// clients get the latest picture. Only the loop sends to the channel, so
+// once a frame is taken out the send can only fail if the channel was
+// drained meanwhile by the client, which leaves room anyway.
+func replaceOldest(s *Subscriber, frame Frame) bool {
+	select {
+	case old := <-s.ChunkChannel:
+		old.Release()
+	default:
+	}
+
+	select {
+	case s.ChunkChannel <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pubSub *PubSub) doSubscribe(s *Subscriber) {
+	if pubSub.MaxSubscribers > 0 && len(pubSub.subscribers) >= pubSub.MaxSubscribers {
+		pubSub.log.Info("rejected subscriber",
+			"client", s.RemoteAddr, "limit", pubSub.MaxSubscribers)
+		s.err = errTooManySubscribers
+		close(s.ChunkChannel)
+		return
+	}
+
+	if len(pubSub.subscribers) == 0 {
+		pubSub.cancelStop()
+	}
+
+	pubSub.subscribers[s] = struct{}{}
+	atomic.StoreInt64(&pubSub.stats.subscribers, int64(len(pubSub.subscribers)))
+
+	pubSub.log.Debug("added subscriber",
+		"client", s.RemoteAddr, "total", len(pubSub.subscribers))
+
+	if pubSub.pubChan == nil && !pubSub.onStandby {
+		pubSub.startChunker()
+		return // nothing cached from a freshly started stream
+	}
+
+	// show the current picture right away instead of waiting for the
+	// next frame, which can take a while on slow streams
+	if frame := pubSub.cachedFrame(); frame.Data != nil {
+		s.ChunkChannel <- frame // the channel is still empty
+		s.lastSent = time.Now()
+	}
+}
+
+// setLastFrame caches the frame for new subscribers, an empty one
+// clears it. The cache holds a reference to the frame.
+func (pubSub *PubSub) setLastFrame(frame Frame, now time.Time) {
+	pubSub.frameMutex.Lock()
+	defer pubSub.frameMutex.Unlock()
+
+	frame.retain()
+	pubSub.lastFrame.Release()
+	pubSub.lastFrame = frame
+	pubSub.lastFrameTime = now
+}
+
+// cachedFrame returns the last frame of the running stream, unless it is
+// so old that the source looks stalled. The caller releases it.
+func (pubSub *PubSub) cachedFrame() Frame {
+	pubSub.frameMutex.Lock()
+	defer pubSub.frameMutex.Unlock()
+
+	if pubSub.FrameTimeout > 0 && time.Since(pubSub.lastFrameTime) > pubSub.FrameTimeout {
+		return Frame{}
+	}
+	pubSub.lastFrame.retain()
+	return pubSub.lastFrame
+}
+
+// stopSubscribers drops all the subscribers, telling them why with err
+// when it is not nil.
+func (pubSub *PubSub) stopSubscribers(err error) {
+	for s := range pubSub.subscribers {
+		s.err = err
+		close(s.ChunkChannel)
+		pubSub.doUnsubscribe(s)
+	}
+}
+
+func (pubSub *PubSub) doUnsubscribe(s *Subscriber) {
+	if _, exists := pubSub.subscribers[s]; !exists {
+		return // already unsubscribed if chunker failed
+	}
+
+	delete(pubSub.subscribers, s)
+	atomic.StoreInt64(&pubSub.stats.subscribers, int64(len(pubSub.subscribers)))
+
+	pubSub.log.Debug("removed subscriber",
+		"client", s.RemoteAddr, "total", len(pubSub.subscribers))
+
+	pubSub.checkMassDisconnect(s)
+
+	// keep the source connected for a while in case clients come back,
+	// like a viewer reloading the page
+	if len(pubSub.subscribers) == 0 && !pubSub.Eager {
+		pubSub.cancelStop()
+		pubSub.stopTimer.Reset(pubSub.StopDelay)
+	}
+}
+
+// cancelStop stops a pending stop of the chunker, draining the timer so
+// it can be reset.
+func (pubSub *PubSub) cancelStop() {
+	if !pubSub.stopTimer.Stop() {
+		select {
+		case <-pubSub.stopTimer.C:
+		default:
+		}
+	}
+}
+
+// checkMassDisconnect reports when all the subscribers fail to receive
+// data at about the same time. This usually points to a network problem
+// on the serving side rather than a problem with the source.
+func (pubSub *PubSub) checkMassDisconnect(s *Subscriber) {
+	if pubSub.MassDisconnectWindow <= 0 {
+		return
+	}
+
+	if !s.writeFailed {
+		pubSub.failCount = 0 // normal disconnect
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(pubSub.failStart) > pubSub.MassDisconnectWindow {
+		pubSub.failStart = now
+		pubSub.failCount = 0
+	}
+	pubSub.failCount++
+
+	if len(pubSub.subscribers) == 0 && pubSub.failCount >= massDisconnectMin {
+		count := atomic.AddInt64(&pubSub.stats.massDisconnects, 1)
+		pubSub.log.Warn("mass disconnect", "subscribers", pubSub.failCount,
+			"within", now.Sub(pubSub.failStart), "count", count)
+		pubSub.failCount = 0
+	}
+}
+
+// startChunker connects to the source in the background, so the loop
+// keeps serving the other requests meanwhile. The result comes back on
+// connectDone to connected. There is only one connect at a time, as the
+// chunker is not safe for concurrent use.
+func (pubSub *PubSub) startChunker() {
+	if pubSub.pubChan != nil {
+		return
+	}
+	if pubSub.connecting {
+		if pubSub.dropConnect {
+			pubSub.startAgain = true // once the cancelled one is done
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pubSub.cancel = cancel
+	pubSub.connecting = true
+
+	chunker := pubSub.chunker
+	go func() {
+		pubSub.connectDone <- chunker.ConnectContext(ctx)
+	}()
+}
+
+// connected starts reading the stream once the source is connected,
+// switching back from the standby source if needed. A failure is passed
+// on to the subscribers, or to the standby source, and an eager stream
+// tries again with a backoff for as long as the proxy runs.
+func (pubSub *PubSub) connected(err error) {
+	pubSub.connecting = false
+
+	if pubSub.dropConnect {
+		pubSub.dropConnect = false
+		if err == nil {
+			pubSub.haltChunker() // connected just before the cancel
+		}
+		pubSub.cancel()
+		if pubSub.startAgain {
+			pubSub.startAgain = false
+			pubSub.startChunker()
+		} else {
+			pubSub.replyRestart(errNotRunning)
+		}
+		return
+	}
+
+	if err != nil {
+		pubSub.cancel()
+		if pubSub.Eager && len(pubSub.subscribers) == 0 {
+			pubSub.log.Warn("eager connect failed", "err", err)
+		} else {
+			pubSub.log.Error("failed to start chunker", "err", err)
+		}
+		if !pubSub.failover() {
+			pubSub.stopSubscribers(connectError{err})
+		}
+		if pubSub.Eager {
+			pubSub.scheduleRestart()
+		}
+		pubSub.replyRestart(err)
+		return
+	}
+
+	pubSub.startTime = time.Now()
+	pubSub.pubChan = make(chan Frame)
+	go pubSub.chunker.Start(pubSub.pubChan)
+
+	if pubSub.Eager {
+		pubSub.restartDelay.Reset()
+	}
+	if pubSub.onStandby {
+		pubSub.log.Info("switching back to primary source")
+		pubSub.onStandby = false
+	}
+	pubSub.replyRestart(nil)
+}
+
+// replyRestart answers the Restart calls waiting for the connect.
+func (pubSub *PubSub) replyRestart(err error) {
+	for _, reply := range pubSub.restartReplies {
+		reply <- err
+	}
+	pubSub.restartReplies = nil
+}
+
+func (pubSub *PubSub) scheduleRestart() {
+	delay := pubSub.restartDelay.Next()
+	pubSub.log.Debug("eager restart scheduled", "delay", delay)
+	pubSub.restartTimer.Reset(delay)
+}
+
+func (pubSub *PubSub) stopChunker() {
+	if pubSub.connecting {
+		pubSub.cancel() // connected drops the connection
+		pubSub.dropConnect = true
+		pubSub.startAgain = false
+	} else if pubSub.pubChan != nil {
+		pubSub.haltChunker()
+		pubSub.cancel() // also aborts a reconnect still in progress
+	}
+
+	pubSub.pubChan = nil
+	pubSub.setLastFrame(Frame{}, time.Time{})
+}
+
+// haltChunker stops the chunker without holding up the loop until the
+// run has ended. The next connect waits for that in its own goroutine.
+func (pubSub *PubSub) haltChunker() {
+	done := pubSub.chunker.halt()
+	go pubSub.chunker.wait(done)
+}
+
+// clientIP strips the port from the client address so that all the
+// connections from the same host are counted together.
+func clientIP(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		host = strings.TrimSpace(client)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
+
+// acquireClient counts a new connection from the client and reports
+// whether it is within the per client limit. Connections are counted
+// from the HTTP handlers, so the map has its own lock.
+func (pubSub *PubSub) acquireClient(ip string) bool {
+	pubSub.clientsMutex.Lock()
+	defer pubSub.clientsMutex.Unlock()
+
+	if pubSub.clients[ip] >= pubSub.MaxClientsPerIP {
+		return false
+	}
+	pubSub.clients[ip]++
+
+	return true
+}
+
+func (pubSub *PubSub) releaseClient(ip string) {
+	pubSub.clientsMutex.Lock()
+	defer pubSub.clientsMutex.Unlock()
+
+	pubSub.clients[ip]--
+	if pubSub.clients[ip] <= 0 {
+		delete(pubSub.clients, ip)
+	}
+}
+
+// setResponseHeaders applies the ResponseHeaders to a response, after
+// the proxy has set its own headers.
+func (pubSub *PubSub) setResponseHeaders(header http.Header) {
+	for key, value := range pubSub.ResponseHeaders {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+}
+
+// writeLegacyPart writes a frame the way older players like to see it,
+// independent of how the source frames it: every boundary follows a
+// CRLF, the first one too, and the part headers are in the order most
+// cameras send them, Content-Type first, ending with an empty line.
+// A seq above 0 is added as X-Frame-Sequence after them.
+func writeLegacyPart(w io.Writer, boundary string, data []byte, seq uint64) error {
+	_, err := fmt.Fprintf(w, "\r\n--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n",
+		boundary, len(data))
+	if err == nil && seq > 0 {
+		_, err = fmt.Fprintf(w, "X-Frame-Sequence: %d\r\n", seq)
+	}
+	if err == nil {
+		_, err = io.WriteString(w, "\r\n")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// countingWriter adds up the bytes written to the client.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// parseMaxRate converts the client requested ?maxrate= in KB/s to bytes
+// per second.
+func parseMaxRate(maxrate string) float64 {
+	kb, err := strconv.ParseFloat(maxrate, 64)
+	if err != nil || kb <= 0 {
+		return 0
+	}
+	return kb * 1024
+}
+
+// sendInterval returns the time between frames for the client requested
+// fps, limited by maxFPS.
+func sendInterval(fps string, maxFPS float64) time.Duration {
+	var interval time.Duration
+	if f, err := strconv.ParseFloat(fps, 64); err == nil && f > 0 {
+		interval = time.Duration(float64(time.Second) / f)
+	}
+
+	if maxFPS > 0 {
+		if limit := time.Duration(float64(time.Second) / maxFPS); interval < limit {
+			interval = limit
+		}
+	}
+
+	return interval
+}
+
+// nextFrame returns the cached frame of a running stream, otherwise it
+// subscribes just long enough to receive a single frame. The caller
+// releases it.
+func (pubSub *PubSub) nextFrame(r *http.Request, timeout time.Duration) (Frame, error) {
+	if frame := pubSub.cachedFrame(); frame.Data != nil {
+		return frame, nil
+	}
+
+	sub := NewSubscriber(pubSub.Access.ClientAddress(r), 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok {
+			if sub.err != nil {
+				return Frame{}, sub.err
+			}
+			return Frame{}, errStreamFailed
+		}
+		return frame, nil
+	case <-timer.C:
+		return Frame{}, errFrameTimeout
+	case <-r.Context().Done():
+		return Frame{}, r.Context().Err()
+	}
+}
+
+// ServeSnapshot responds with a single JPEG frame from the stream.
+func (pubSub *PubSub) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if pubSub.Access.HandleCORS(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", pubSub.Access.AllowedMethods())
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !pubSub.Access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !pubSub.Access.RequireAuth(w, r) {
+		return
+	}
+
+	if !pubSub.Access.RefererAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	frame, err := pubSub.nextFrame(r, pubSub.SnapshotTimeout)
+	if err == errFrameTimeout {
+		pubSub.serverLog.Warn("snapshot frame timeout", "timeout", pubSub.SnapshotTimeout)
+		http.Error(w, "Frame timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		serveFailure(w, pubSub.serverLog.With("client", pubSub.Access.ClientAddress(r)), err)
+		return
+	}
+	defer frame.Release()
+	data := frame.Data
+
+	header := w.Header()
+	header.Set("Content-Type", pubSub.chunker.ContentType())
+	header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+	header.Set("Cache-Control", "no-cache")
+	pubSub.setResponseHeaders(header)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		pubSub.serverLog.Debug("snapshot write failed", "err", err)
+	}
+}
+
+func (pubSub *PubSub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pubSub.Access.HandleCORS(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", pubSub.Access.AllowedMethods())
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !pubSub.Access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !pubSub.Access.RequireAuth(w, r) {
+		return
+	}
+
+	if !pubSub.Access.RefererAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// allow client to lower the frame rate
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	interval := sendInterval(r.FormValue("fps"), pubSub.MaxFPS)
+	maxRate := parseMaxRate(r.FormValue("maxrate"))
+
+	// prepare response for flushing
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		pubSub.serverLog.Error("client could not be flushed", "client", r.RemoteAddr)
+		return
+	}
+
+	// limit connections coming from a single client
+	client := pubSub.Access.ClientAddress(r)
+	log := pubSub.serverLog.With("client", client)
+	if pubSub.MaxClientsPerIP > 0 {
+		ip := clientIP(client)
+		if !pubSub.acquireClient(ip) {
+			log.Info("client over connection limit", "limit", pubSub.MaxClientsPerIP)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer pubSub.releaseClient(ip)
+	}
+
+	// subscribe to new chunks
+	sub := NewSubscriber(client, pubSub.ClientBuffer)
+	sub.interval = interval
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	defer func() {
+		log.Info("session ended", "path", r.URL.Path,
+			"frames", atomic.LoadInt64(&sub.Frames), "bytes", atomic.LoadInt64(&sub.Bytes),
+			"duration", time.Since(sub.Started).Round(time.Millisecond))
+	}()
+
+	// a client waits for its own limit first, then takes its turn in the
+	// total one, so clients held back by ?maxrate= don't take the turns
+	out := pubSub.limitWriter(w, r.Context())
+	if maxRate > 0 {
+		out = throttledWriter{out, newTokenBucket(maxRate), r.Context()}
+	}
+	out = countingWriter{out, &sub.Bytes}
+
+	// optionally collect the small multipart writes into one per frame
+	var bw *bufio.Writer
+	if pubSub.WriteBuffer > 0 {
+		bw = bufio.NewWriterSize(out, pubSub.WriteBuffer)
+		out = bw
+	}
+
+	mw := multipart.NewWriter(out)
+	if pubSub.Boundary != "" {
+		mw.SetBoundary(pubSub.Boundary) // checked by Start
+	}
+	contentType := fmt.Sprintf("multipart/x-mixed-replace; boundary=%s", mw.Boundary())
+
+	mimeHeader := make(textproto.MIMEHeader)
+
+	// the client can reconnect once its session is over
+	var sessionEnd <-chan time.Time
+	if pubSub.MaxSession > 0 {
+		timer := time.NewTimer(pubSub.MaxSession)
+		defer timer.Stop()
+		sessionEnd = timer.C
+	}
+
+	var frame Frame
+	var chunkOk, closed, headersSent bool
+	defer func() { frame.Release() }() // the frame of a failed write
+
+LOOP:
+	for {
+		// wait for next chunk
+		select {
+		case frame, chunkOk = <-sub.ChunkChannel:
+			if !chunkOk {
+				closed = true
+				break LOOP
+			}
+		case <-r.Context().Done():
+			break LOOP
+		case <-sessionEnd:
+			log.Info("session time limit reached", "limit", pubSub.MaxSession)
+			break LOOP
+		}
+
+		// send HTTP header before first chunk, the headers of the source
+		// response (cookies, auth, hop-by-hop) are never passed along and
+		// the parts are written with our own boundary. Accept-Encoding is
+		// ignored, compressing JPEG gains nothing and a proxy doing it
+		// would break the framing for the clients, so tell them not to
+		if !headersSent {
+			header := w.Header()
+			header.Add("Content-Type", contentType)
+			header.Set("Content-Encoding", "identity")
+			header.Set("Cache-Control", "no-cache, no-transform")
+			pubSub.setResponseHeaders(header)
+			w.WriteHeader(http.StatusOK)
+			headersSent = true
+		}
+
+		// the sequence shows clients the frames dropped for them
+		var seq uint64
+		if pubSub.FrameSeq {
+			seq = frame.Seq
+		}
+
+		data := frame.Data
+		if pubSub.ClientCompat {
+			err = writeLegacyPart(out, mw.Boundary(), data, seq)
+			if err != nil {
+				log.Debug("part write failed", "err", err, "size", len(data))
+				sub.writeFailed = true
+				return
+			}
+		} else {
+			for name := range mimeHeader {
+				delete(mimeHeader, name)
+			}
+			for name, values := range frame.Header {
+				mimeHeader[name] = values
+			}
+			mimeHeader.Set("Content-Type", pubSub.chunker.ContentType())
+			mimeHeader.Set("Content-Length", fmt.Sprintf("%d", len(data)))
+			if seq > 0 {
+				mimeHeader.Set("X-Frame-Sequence", strconv.FormatUint(seq, 10))
+			}
+			part, err := mw.CreatePart(mimeHeader)
+			if err != nil {
+				log.Debug("part create failed", "err", err)
+				sub.writeFailed = true
+				return
+			}
+
+			// send image to client
+			_, err = part.Write(data)
+			if err != nil {
+				log.Debug("part write failed", "err", err, "size", len(data))
+				sub.writeFailed = true
+				return
+			}
+		}
+
+		if bw != nil {
+			err = bw.Flush()
+			if err != nil {
+				log.Debug("buffer flush failed", "err", err)
+				sub.writeFailed = true
+				return
+			}
+		}
+		flusher.Flush()
+		atomic.AddInt64(&sub.Frames, 1)
+
+		frame.Release()
+		frame = Frame{}
+	}
+
+	// only a dropped subscriber has a failure to report, a client that went
+	// away or ran out of session time before the first frame gets nothing
+	if !headersSent {
+		if closed {
+			serveFailure(w, log, sub.err)
+		}
+		return
+	}
+
+	if pubSub.ClientCompat {
+		_, err = fmt.Fprintf(out, "\r\n--%s--\r\n", mw.Boundary())
+	} else {
+		err = mw.Close()
+	}
+	if err != nil {
+		log.Debug("mime close failed", "err", err)
+	}
+
+	if bw != nil {
+		err = bw.Flush()
+		if err != nil {
+			log.Debug("buffer flush failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,1197 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// liveSourceServer keeps sending the test frames until the client goes
+// away, like a camera would.
+func liveSourceServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=myboundary")
+		w.Header().Set("Set-Cookie", "session=camera")
+		flusher := w.(http.Flusher)
+
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for i := 0; ; i++ {
+			data := testFrames[i%len(testFrames)]
+			fmt.Fprintf(w, "--myboundary\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(data))
+			w.Write(data)
+			io.WriteString(w, "\r\n")
+			flusher.Flush()
+
+			select {
+			case <-ticker.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+
+	return server
+}
+
+func newTestPubSub(t *testing.T, source string) *PubSub {
+	t.Helper()
+
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, source), nil)
+	pubSub.Start()
+	return pubSub
+}
+
+func isTestFrame(data []byte) bool {
+	for _, frame := range testFrames {
+		if bytes.Equal(data, frame) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServeHTTP(t *testing.T) {
+	source := liveSourceServer(t)
+	server := httptest.NewServer(newTestPubSub(t, source.URL))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("Content-Type = %q, %v", resp.Header.Get("Content-Type"), err)
+	}
+
+	if cookie := resp.Header.Get("Set-Cookie"); cookie != "" {
+		t.Errorf("source cookie forwarded: %s", cookie)
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; i < 3; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("part %d Content-Type = %q", i, ct)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		if !isTestFrame(data) {
+			t.Errorf("part %d = %q, not a source frame", i, data)
+		}
+	}
+}
+
+func TestClientBoundary(t *testing.T) {
+	// the source uses a different boundary, declared with dashes
+	body := part("--myboundary\r\nContent-Type: image/jpeg\r\n\r\n", string(testFrames[0])) +
+		part("--myboundary\r\nContent-Type: image/jpeg\r\n\r\n", string(testFrames[1])) +
+		"--myboundary--\r\n"
+	source := sourceServer(t, "multipart/x-mixed-replace; boundary=--myboundary", body)
+
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.Boundary = "proxyboundary"
+	w := httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	want := "multipart/x-mixed-replace; boundary=proxyboundary"
+	if ct := w.Header().Get("Content-Type"); ct != want {
+		t.Fatalf("Content-Type = %q, want %q", ct, want)
+	}
+
+	mr := multipart.NewReader(w.Body, "proxyboundary")
+	for i, frame := range testFrames {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %s", i, err)
+		}
+		data, _ := io.ReadAll(part)
+		if !bytes.Equal(data, frame) {
+			t.Errorf("part %d = %q, want %q", i, data, frame)
+		}
+	}
+}
+
+func TestValidBoundary(t *testing.T) {
+	for _, boundary := range []string{"", "proxyboundary", "a'()+_,-./:=?"} {
+		if err := validBoundary(boundary); err != nil {
+			t.Errorf("validBoundary(%q): %s", boundary, err)
+		}
+	}
+	for _, boundary := range []string{"bad boundary ", "bad\r\n", strings.Repeat("x", 71)} {
+		if err := validBoundary(boundary); err == nil {
+			t.Errorf("validBoundary(%q) accepted", boundary)
+		}
+	}
+}
+
+func TestConnectFailure(t *testing.T) {
+	html := sourceServer(t, "text/html", "<html>Login</html>")
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		source string
+		body   string
+	}{
+		{html.URL, "Source is not an MJPEG stream"},
+		{down.URL, "Source connection failed"},
+	}
+
+	for _, tt := range tests {
+		pubSub := newTestPubSub(t, tt.source)
+		pubSub.SnapshotTimeout = 5 * time.Second
+
+		for _, target := range []string{"/test", "/test/snapshot"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if target == "/test" {
+				pubSub.ServeHTTP(w, r)
+			} else {
+				pubSub.ServeSnapshot(w, r)
+			}
+
+			if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("%s %s = %d %q, want %d %q", tt.source, target,
+					w.Code, w.Body.String(), http.StatusBadGateway, tt.body)
+			}
+		}
+	}
+}
+
+func TestCanceledBeforeFrame(t *testing.T) {
+	// a source answering but not sending any frames
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=myboundary")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(func() {
+		source.CloseClientConnections()
+		source.Close()
+	})
+	pubSub := newTestPubSub(t, source.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	w := httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx))
+	if w.Code != http.StatusOK || w.Body.Len() != 0 {
+		t.Errorf("canceled request answered %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestSlowConnect checks that the loop keeps answering while the source
+// takes its time to answer the connect.
+func TestSlowConnect(t *testing.T) {
+	release := make(chan struct{})
+	live := liveSourceServer(t)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Redirect(w, r, live.URL, http.StatusFound)
+	}))
+	t.Cleanup(source.Close)
+	pubSub := newTestPubSub(t, source.URL)
+
+	sub := NewSubscriber("test", 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	status := make(chan StreamStatus)
+	go func() { status <- pubSub.Status() }()
+	select {
+	case s := <-status:
+		if s.Subscribers != 1 || s.Connected {
+			t.Errorf("status during connect = %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop blocked by the connect")
+	}
+
+	close(release)
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok || !isTestFrame(frame.Data) {
+			t.Fatalf("got %q, %v after the connect", frame.Data, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame after the connect")
+	}
+}
+
+// TestSlowStop checks that the loop keeps answering while the stopped
+// chunker takes its time to end the run.
+func TestSlowStop(t *testing.T) {
+	source := liveSourceServer(t)
+	chunker := newTestChunker(t, source.URL)
+	chunker.StopTimeout = time.Minute
+
+	release := make(chan struct{})
+	defer close(release)
+	chunker.OnStateChange = func(state string) {
+		if state == StateStopped {
+			<-release
+		}
+	}
+
+	pubSub := NewPubSub("test", "/test", chunker, nil)
+	pubSub.Start()
+
+	sub := NewSubscriber("test", 1)
+	pubSub.Subscribe(sub)
+	<-sub.ChunkChannel
+	pubSub.Unsubscribe(sub) // stops the chunker right away
+
+	deadline := time.Now().Add(5 * time.Second)
+	for chunker.Started() {
+		if time.Now().After(deadline) {
+			t.Fatal("chunker not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	status := make(chan StreamStatus)
+	go func() { status <- pubSub.Status() }()
+	select {
+	case <-status:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop blocked by the stop")
+	}
+}
+
+func TestServeSnapshot(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.SnapshotTimeout = 5 * time.Second
+
+	w := httptest.NewRecorder()
+	pubSub.ServeSnapshot(w, httptest.NewRequest(http.MethodGet, "/test.jpg", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !isTestFrame(w.Body.Bytes()) {
+		t.Errorf("snapshot = %q, not a source frame", w.Body.Bytes())
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+
+	pubSub.Access = &Access{User: "viewer", Pass: "secret"}
+	pubSub.SnapshotTimeout = 5 * time.Second
+
+	tests := []struct {
+		user, pass string
+		status     int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"viewer", "wrong", http.StatusUnauthorized},
+		{"viewer", "secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/test.jpg", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		pubSub.ServeSnapshot(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s:%s status = %d, want %d", tt.user, tt.pass, w.Code, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s:%s missing WWW-Authenticate", tt.user, tt.pass)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+
+	pubSub.Access = &Access{Tokens: []string{"first", "second"}}
+
+	tests := []struct {
+		target string
+		header string
+		status int
+	}{
+		{"/test", "", http.StatusForbidden},
+		{"/test?token=wrong", "", http.StatusForbidden},
+		{"/test", "wrong", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Auth-Token", tt.header)
+		}
+		w := httptest.NewRecorder()
+		pubSub.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %q status = %d, want %d", tt.target, tt.header, w.Code, tt.status)
+		}
+	}
+	if pubSub.chunker.Started() {
+		t.Error("chunker started for rejected clients")
+	}
+
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	for _, target := range []string{"/test?token=second", "/test"} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+target, nil)
+		if target == "/test" {
+			req.Header.Set("X-Auth-Token", "first")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s status = %d, want %d", target, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestMaxSubscribers(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, source.URL), nil)
+	pubSub.MaxSubscribers = 1
+	pubSub.Start()
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	first, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer first.Body.Close()
+
+	second, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	second.Body.Close()
+
+	if second.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("second viewer status = %d, want %d", second.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+// TestSubscribeChurn subscribes and unsubscribes from many goroutines, so
+// the chunker is stopped and started over and over. Run it with -race.
+func TestSubscribeChurn(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				sub := NewSubscriber("test", 1)
+				pubSub.Subscribe(sub)
+				select {
+				case <-sub.ChunkChannel:
+				case <-time.After(time.Second):
+				}
+				pubSub.Status()
+				pubSub.Unsubscribe(sub)
+			}
+		}()
+	}
+	wg.Wait()
+
+	sub := NewSubscriber("test", 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	select {
+	case frame, ok := <-sub.ChunkChannel:
+		if !ok || !isTestFrame(frame.Data) {
+			t.Fatalf("got %q, %v after churn", frame.Data, ok)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame after churn")
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	source := liveSourceServer(t)
+	server := httptest.NewServer(http.HandlerFunc(newTestPubSub(t, source.URL).ServeEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for i := 0; i < 2; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event %d: %s", i, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(strings.TrimPrefix(line, "data: "), "\n"))
+		if err != nil || !isTestFrame(data) {
+			t.Fatalf("event %d = %q, %v", i, line, err)
+		}
+		if blank, _ := r.ReadString('\n'); blank != "\n" {
+			t.Fatalf("event %d not terminated: %q", i, blank)
+		}
+	}
+}
+
+func TestMaxSession(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.MaxSession = 200 * time.Millisecond
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("session lasted %s", elapsed)
+	}
+	if !bytes.HasSuffix(bytes.TrimSpace(body), []byte("--")) {
+		t.Errorf("stream not closed with the final boundary: %q", body[len(body)-20:])
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pubSub.Status().Subscribers != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber not removed after the session ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientCompat(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.Boundary = "pb"
+	pubSub.ClientCompat = true
+	pubSub.MaxSession = 200 * time.Millisecond
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+
+	// ffmpeg (mpjpeg) and older VLC want the CRLF before every boundary
+	// and the headers of each part closed by an empty line
+	first := false
+	for _, frame := range testFrames {
+		head := fmt.Sprintf("\r\n--pb\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(frame))
+		if bytes.HasPrefix(body, append([]byte(head), frame...)) {
+			first = true
+		}
+	}
+	if !first {
+		t.Errorf("unexpected first part: %q", body[:60])
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n--pb--\r\n")) {
+		t.Errorf("unexpected stream end: %q", body[len(body)-20:])
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), "pb")
+	parts := 0
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("part %d: %s", parts, err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("part %d: %s", parts, err)
+		}
+		if !isTestFrame(data) {
+			t.Errorf("part %d = %q", parts, data)
+		}
+		parts++
+	}
+	if parts == 0 {
+		t.Error("no parts in the stream")
+	}
+}
+
+func TestNoCompression(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.MaxSession = 200 * time.Millisecond
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	// no transparent decompression, the body is checked as sent
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "identity" {
+		t.Errorf("Content-Encoding = %q, want identity", encoding)
+	}
+	if cache := resp.Header.Get("Cache-Control"); !strings.Contains(cache, "no-transform") {
+		t.Errorf("Cache-Control = %q, want no-transform", cache)
+	}
+	if !bytes.HasPrefix(body, []byte("--")) || !bytes.Contains(body, testFrames[0]) {
+		t.Errorf("body is not a plain multipart stream: %q", body[:20])
+	}
+}
+
+func TestFrameSeq(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.FrameSeq = true
+	pubSub.MaxSession = 300 * time.Millisecond
+
+	for _, compat := range []bool{false, true} {
+		pubSub.ClientCompat = compat
+		w := httptest.NewRecorder()
+		pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+		_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("Content-Type: %s", err)
+		}
+		mr := multipart.NewReader(w.Body, params["boundary"])
+
+		var last uint64
+		parts := 0
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("compat %v, part %d: %s", compat, parts, err)
+			}
+			seq, err := strconv.ParseUint(part.Header.Get("X-Frame-Sequence"), 10, 64)
+			if err != nil || seq <= last {
+				t.Fatalf("compat %v, part %d: sequence %q after %d",
+					compat, parts, part.Header.Get("X-Frame-Sequence"), last)
+			}
+			last = seq
+			parts++
+		}
+		if parts == 0 {
+			t.Errorf("compat %v: no parts in the stream", compat)
+		}
+	}
+}
+
+func TestTotalBandwidth(t *testing.T) {
+	const rate = 8192
+
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.TotalBandwidth = NewBandwidth(rate)
+	pubSub.MaxSession = time.Second
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	sizes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				sizes <- 0
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			sizes <- len(body)
+		}()
+	}
+	first, second := <-sizes, <-sizes
+
+	// the source sends about twice as much, up to a burst is let
+	// through right away
+	if total := first + second; total > 4096+rate*3/2 {
+		t.Errorf("clients got %d bytes in a second, limit %d", total, rate)
+	}
+	if first < rate/8 || second < rate/8 {
+		t.Errorf("uneven shares: %d and %d bytes", first, second)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	// a slow camera: one frame, then nothing for a long time. The
+	// boundary after the frame is needed to end its part.
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+		fmt.Fprintf(w, "--b\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--b\r\n", testFrames[0])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer func() {
+		source.CloseClientConnections()
+		source.Close()
+	}()
+
+	pubSub := newTestPubSub(t, source.URL)
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type: %s", err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatalf("first part: %s", err)
+	}
+	resp.Body.Close()
+
+	// noticed without waiting for a write to the gone client
+	deadline := time.Now().Add(time.Second)
+	for pubSub.Status().Subscribers != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber kept after the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.SnapshotTimeout = 5 * time.Second
+	pubSub.MaxSession = 100 * time.Millisecond
+	pubSub.ResponseHeaders = map[string]string{
+		"Cache-Control": "no-cache, no-store",
+		"Pragma":        "no-cache",
+		"X-Camera":      "garage",
+	}
+
+	for name, handler := range map[string]http.HandlerFunc{
+		"stream":   pubSub.ServeHTTP,
+		"snapshot": pubSub.ServeSnapshot,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+		for key, want := range pubSub.ResponseHeaders {
+			if got := w.Header().Get(key); got != want {
+				t.Errorf("%s: %s = %q, want %q", name, key, got, want)
+			}
+		}
+	}
+
+	pubSub.ResponseHeaders = map[string]string{"Cache-Control": ""}
+	w := httptest.NewRecorder()
+	pubSub.ServeSnapshot(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+	if _, ok := w.Header()["Cache-Control"]; ok {
+		t.Errorf("Cache-Control not removed: %q", w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestOutputFPS(t *testing.T) {
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, "http://camera/mjpg"), nil)
+	pubSub.OutputFPS = 20
+	pubSub.OutputFPSCap = func() float64 { return 50 } // the lower one applies
+
+	// a 100 fps source for half a second
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		pubSub.doPublish(Frame{Data: testFrames[0]})
+		time.Sleep(10 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+
+	stats := pubSub.Stats()
+	want := elapsed.Seconds() * pubSub.OutputFPS
+	if float64(stats.Frames) < want-2 || float64(stats.Frames) > want+2 {
+		t.Errorf("published %d frames in %s, want about %.0f", stats.Frames, elapsed, want)
+	}
+	if stats.Frames+stats.Throttled != 50 {
+		t.Errorf("%d published and %d throttled, want 50 together", stats.Frames, stats.Throttled)
+	}
+	if stats.Dropped != 0 {
+		t.Errorf("%d frames counted as dropped, want them throttled", stats.Dropped)
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	var down int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			http.Error(w, "camera offline", http.StatusServiceUnavailable)
+			return
+		}
+		// one frame and the connection drops
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+		io.WriteString(w, part("--b\r\nContent-Type: image/jpeg\r\n\r\n", string(testFrames[0]))+"--b\r\n")
+		atomic.StoreInt32(&down, 1)
+	}))
+	defer source.Close()
+
+	backoff, _ := NewBackoff(50*time.Millisecond, 50*time.Millisecond, "none")
+	chunker, err := NewSourceChunker(source.URL, WithRetries(1000, backoff))
+	if err != nil {
+		t.Fatalf("NewSourceChunker: %s", err)
+	}
+	placeholder := []byte("\xff\xd8no signal\xff\xd9")
+	pubSub := NewPubSub("test", "/test", chunker, nil)
+	pubSub.Placeholder = placeholder
+	if err := pubSub.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+
+	sub := NewSubscriber("client", 4)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	next := func() Frame {
+		select {
+		case frame := <-sub.ChunkChannel:
+			return frame
+		case <-time.After(5 * time.Second):
+			t.Fatal("no frame for the subscriber")
+		}
+		return Frame{}
+	}
+
+	if frame := next(); !isTestFrame(frame.Data) {
+		t.Fatalf("got %q, want the source frame first", frame.Data)
+	}
+	if frame := next(); !bytes.Equal(frame.Data, placeholder) {
+		t.Fatalf("got %q, want the placeholder while the source is down", frame.Data)
+	}
+
+	atomic.StoreInt32(&down, 0)
+	for {
+		frame := next()
+		if isTestFrame(frame.Data) {
+			break
+		}
+		if !bytes.Equal(frame.Data, placeholder) {
+			t.Fatalf("got %q, want the placeholder until the source is back", frame.Data)
+		}
+	}
+
+	if frames := pubSub.Stats().Frames; frames != 2 {
+		t.Errorf("counted %d frames, want only the 2 from the source", frames)
+	}
+}
+
+func TestPlaceholderNotJPEG(t *testing.T) {
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, "http://camera/mjpg"), nil)
+	pubSub.Placeholder = []byte("<svg/>")
+	if err := pubSub.Start(); err == nil {
+		t.Error("Start accepted a placeholder that is not a JPEG image")
+	}
+}
+
+func TestPartHeaders(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+		flusher := w.(http.Flusher)
+		for i := 0; ; i++ {
+			fmt.Fprintf(w, "--b\r\nContent-Type: image/jpg\r\nX-Timestamp: %d\r\nX-Vendor-Gain: 3\r\n\r\n", i)
+			w.Write(testFrames[0])
+			io.WriteString(w, "\r\n")
+			flusher.Flush()
+
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer func() {
+		source.CloseClientConnections()
+		source.Close()
+	}()
+
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, source.URL), nil)
+	pubSub.PartHeaders = []string{"*", "x-vendor-gain:", "X-Camera: lobby"}
+	pubSub.MaxSession = 300 * time.Millisecond
+	if err := pubSub.Start(); err != nil {
+		t.Fatalf("Start: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	pubSub.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+	_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type: %s", err)
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart: %s", err)
+	}
+
+	want := map[string]string{
+		"Content-Type":   "image/jpeg",
+		"Content-Length": strconv.Itoa(len(testFrames[0])),
+		"X-Camera":       "lobby",
+		"X-Vendor-Gain":  "",
+	}
+	for name, value := range want {
+		if got := part.Header.Get(name); got != value {
+			t.Errorf("part header %s = %q, want %q", name, got, value)
+		}
+	}
+	if _, err := strconv.Atoi(part.Header.Get("X-Timestamp")); err != nil {
+		t.Errorf("part header X-Timestamp = %q, want the source one", part.Header.Get("X-Timestamp"))
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	// one frame, then nothing until the session ends, so the frame has
+	// to go out with its flush and not with the final boundary
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+		fmt.Fprintf(w, "--b\r\nContent-Type: image/jpeg\r\n\r\n%s\r\n--b\r\n", testFrames[0])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer func() {
+		source.CloseClientConnections()
+		source.Close()
+	}()
+
+	pubSub := newTestPubSub(t, source.URL)
+	pubSub.WriteBuffer = 1 << 20
+	pubSub.MaxSession = time.Second
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	buf := make([]byte, 4096)
+	for !bytes.Contains(body, testFrames[0]) {
+		n, err := resp.Body.Read(buf)
+		body = append(body, buf[:n]...)
+		if err != nil {
+			t.Fatalf("read: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= pubSub.MaxSession {
+		t.Errorf("frame only arrived after %s, at the end of the session", elapsed)
+	}
+
+	// the rest, up to the disconnect at the end of the session
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	body = append(body, rest...)
+	if !bytes.HasSuffix(bytes.TrimSpace(body), []byte("--")) {
+		t.Errorf("final boundary not flushed: %q", body)
+	}
+}
+
+// countingConn counts the writes that reach the network.
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+type countingListener struct {
+	net.Listener
+	writes *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, l.writes}, nil
+}
+
+// BenchmarkWriteBuffer serves small and 4K sized frames to a client
+// without and with WriteBuffer, reporting the writes to the client
+// connection per frame.
+func BenchmarkWriteBuffer(b *testing.B) {
+	for _, frameSize := range []int{8 << 10, frame4K} {
+		frame := make([]byte, frameSize)
+		source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary=b")
+			for r.Context().Err() == nil {
+				fmt.Fprintf(w, "--b\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(frame))
+				w.Write(frame)
+				io.WriteString(w, "\r\n")
+			}
+		}))
+
+		for _, size := range []int{0, 64 << 10} {
+			b.Run(fmt.Sprintf("frame=%d/writebuffer=%d", frameSize, size), func(b *testing.B) {
+				benchmarkWriteBuffer(b, source.URL, frameSize, size)
+			})
+		}
+
+		source.CloseClientConnections()
+		source.Close()
+	}
+}
+
+func benchmarkWriteBuffer(b *testing.B, source string, frameSize, size int) {
+	chunker, err := NewSourceChunker(source, WithName("bench"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	pubSub := NewPubSub("bench", "/bench", chunker, nil)
+	pubSub.WriteBuffer = size
+	pubSub.ClientBuffer = 4 // keep the client busy instead of dropping
+	pubSub.Start()
+
+	var writes int64
+	server := httptest.NewUnstartedServer(pubSub)
+	server.Listener = countingListener{server.Listener, &writes}
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+
+	b.SetBytes(int64(frameSize))
+	b.ResetTimer()
+	atomic.StoreInt64(&writes, 0)
+	for i := 0; i < b.N; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N), "writes/frame")
+}
+
+func pooledFrame(data []byte) Frame {
+	fb := newFrameBuffer()
+	fb.buf.Write(data)
+	return Frame{Data: fb.buf.Bytes(), buf: fb}
+}
+
+func TestFrameRefs(t *testing.T) {
+	pubSub := NewPubSub("test", "/test", newTestChunker(t, "http://camera/mjpg"), nil)
+	pubSub.DropPolicy = DropOld
+	subs := []*Subscriber{NewSubscriber("a", 1), NewSubscriber("b", 1)}
+	for _, s := range subs {
+		pubSub.subscribers[s] = struct{}{}
+	}
+	refs := func(frame Frame) int32 {
+		return atomic.LoadInt32(&frame.buf.refs)
+	}
+
+	// held by both queues and the cache
+	first := pooledFrame(testFrames[0])
+	pubSub.doPublish(first)
+	if n := refs(first); n != 3 {
+		t.Fatalf("published: %d references, want 3", n)
+	}
+
+	// the full queues give up the first frame for the second one
+	second := pooledFrame(testFrames[1])
+	pubSub.doPublish(second)
+	if n := refs(first); n != 0 {
+		t.Errorf("replaced: %d references to the first frame, want 0", n)
+	}
+	if n := refs(second); n != 3 {
+		t.Errorf("replaced: %d references to the second frame, want 3", n)
+	}
+
+	for _, s := range subs {
+		frame := <-s.ChunkChannel
+		if !bytes.Equal(frame.Data, testFrames[1]) {
+			t.Errorf("queued %q, want %q", frame.Data, testFrames[1])
+		}
+		frame.Release()
+	}
+	if n := refs(second); n != 1 {
+		t.Errorf("written: %d references, want the cache only", n)
+	}
+
+	frame := pubSub.cachedFrame()
+	pubSub.setLastFrame(Frame{}, time.Time{})
+	if n := refs(second); n != 1 {
+		t.Errorf("cache cleared: %d references, want the snapshot only", n)
+	}
+	frame.Release()
+	if n := refs(second); n != 0 {
+		t.Errorf("snapshot written: %d references, want 0", n)
+	}
+}
+
+func TestPooledRead(t *testing.T) {
+	source := liveSourceServer(t)
+	chunker := newTestChunker(t, source.URL)
+	chunker.PooledRead = true
+	pubSub := NewPubSub("test", "/test", chunker, nil)
+	pubSub.Start()
+	server := httptest.NewServer(pubSub)
+	defer server.Close()
+
+	// frames reused too early would show up as garbled data
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Errorf("GET: %s", err)
+				return
+			}
+			defer resp.Body.Close()
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil {
+				t.Errorf("Content-Type: %s", err)
+				return
+			}
+
+			mr := multipart.NewReader(resp.Body, params["boundary"])
+			for j := 0; j < 10; j++ {
+				part, err := mr.NextPart()
+				if err != nil {
+					t.Errorf("part %d: %s", j, err)
+					return
+				}
+				data, err := io.ReadAll(part)
+				if err != nil || !isTestFrame(data) {
+					t.Errorf("part %d = %q, %v", j, data, err)
+				}
+
+				r := httptest.NewRequest(http.MethodGet, "/test/snapshot", nil)
+				w := httptest.NewRecorder()
+				pubSub.ServeSnapshot(w, r)
+				if !isTestFrame(w.Body.Bytes()) {
+					t.Errorf("snapshot %d = %q", j, w.Body.Bytes())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,133 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits a byte rate. Writers reserve the bytes up front and
+// wait off any debt, so a bucket shared by several writers serves them
+// in turn. It is safe for concurrent use.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	bucket := new(tokenBucket)
+
+	bucket.rate = rate
+	bucket.burst = rate / 10 // 100ms worth of data
+	if bucket.burst < 4096 {
+		bucket.burst = 4096
+	}
+	bucket.tokens = bucket.burst
+	bucket.last = time.Now()
+
+	return bucket
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// before sending them.
+func (bucket *tokenBucket) reserve(n int) time.Duration {
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	now := time.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+
+	bucket.tokens -= float64(n)
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+// Bandwidth is a byte rate shared by all the clients of the streams it
+// is set for, see Options.TotalBandwidth. The clients take turns in
+// pieces of at most the burst size, so a client sending big frames
+// doesn't hold up the others.
+type Bandwidth struct {
+	bucket *tokenBucket
+}
+
+// NewBandwidth creates a limit of bytesPerSecond for all the clients
+// together.
+func NewBandwidth(bytesPerSecond float64) *Bandwidth {
+	return &Bandwidth{newTokenBucket(bytesPerSecond)}
+}
+
+// limitWriter makes the writes to a client count against the total
+// bandwidth of the stream, if there is one.
+func (pubSub *PubSub) limitWriter(w io.Writer, ctx context.Context) io.Writer {
+	if pubSub.TotalBandwidth == nil {
+		return w
+	}
+	return throttledWriter{w, pubSub.TotalBandwidth.bucket, ctx}
+}
+
+// throttledWriter delays the writes to keep within the bucket rate. The
+// waits end early when the context is done, so a gone client doesn't
+// hold on to its subscription.
+type throttledWriter struct {
+	w      io.Writer
+	bucket *tokenBucket
+	ctx    context.Context
+}
+
+func (tw throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if limit := int(tw.bucket.burst); len(chunk) > limit {
+			chunk = chunk[:limit]
+		}
+
+		if wait := tw.bucket.reserve(len(chunk)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,172 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// recordBoundary separates the frames in the recorded files, which can
+// be played back as mpjpeg, for example with ffplay -f mpjpeg.
+const recordBoundary = "mjpegproxy"
+
+// Recorder writes all the frames of a stream to a file. It subscribes
+// like an HTTP client would, so the source stays connected while it is
+// recording.
+type Recorder struct {
+	pubSub   *PubSub
+	filename string
+	maxSize  int64 // rotate the file above this size, 0 for no limit
+	backoff  *Backoff
+	log      *slog.Logger
+
+	file    *os.File
+	size    int64
+	failing bool
+}
+
+func NewRecorder(pubSub *PubSub, filename string, maxSize int64) (*Recorder, error) {
+	backoff, err := pubSub.newBackoff()
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &Recorder{
+		pubSub:   pubSub,
+		filename: filename,
+		maxSize:  maxSize,
+		backoff:  backoff,
+		log:      logger.With("component", "recorder", "stream", pubSub.id, "file", filename),
+	}
+
+	return recorder, nil
+}
+
+// RecordFileName adds the stream name to the recording file name when
+// several streams are recorded.
+func RecordFileName(filename, id string) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(filename, ext), fileSafeName(id), ext)
+}
+
+func (recorder *Recorder) Start() {
+	go recorder.run()
+}
+
+func (recorder *Recorder) run() {
+	for {
+		sub := NewSubscriber("recorder", 4)
+		recorder.pubSub.Subscribe(sub)
+
+		for frame := range sub.ChunkChannel {
+			recorder.backoff.Reset()
+			recorder.write(frame.Data)
+			frame.Release()
+		}
+
+		// the source failed, subscribe again to restart it
+		recorder.pubSub.Unsubscribe(sub)
+		delay := recorder.backoff.Next()
+		recorder.log.Debug("waiting for stream", "delay", delay)
+		time.Sleep(delay)
+	}
+}
+
+// write appends a frame to the file. Errors are logged once until
+// writing works again, the frames in between are lost.
+func (recorder *Recorder) write(data []byte) {
+	err := recorder.writeFrame(data)
+	if err != nil {
+		if !recorder.failing {
+			recorder.log.Error("recording failed", "err", err)
+			recorder.failing = true
+		}
+		if recorder.file != nil {
+			recorder.file.Close()
+			recorder.file = nil
+		}
+		return
+	}
+
+	if recorder.failing {
+		recorder.log.Info("recording resumed")
+		recorder.failing = false
+	}
+}
+
+func (recorder *Recorder) writeFrame(data []byte) error {
+	header := fmt.Sprintf("--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+		recordBoundary, len(data))
+	partSize := int64(len(header) + len(data) + 2)
+
+	if recorder.file != nil && recorder.maxSize > 0 && recorder.size > 0 &&
+		recorder.size+partSize > recorder.maxSize {
+		err := recorder.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if recorder.file == nil {
+		err := recorder.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := fmt.Fprintf(recorder.file, "%s%s\r\n", header, data)
+	recorder.size += int64(n)
+	return err
+}
+
+func (recorder *Recorder) open() error {
+	file, err := os.OpenFile(recorder.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	recorder.file = file
+	recorder.size = info.Size()
+	return nil
+}
+
+// rotate keeps the full file as <file>.1, replacing the older one, so
+// at most twice the maximum size is used on disk.
+func (recorder *Recorder) rotate() error {
+	err := recorder.file.Close()
+	recorder.file = nil
+	if err != nil {
+		return err
+	}
+
+	recorder.log.Info("rotating recording", "size", recorder.size)
+	return os.Rename(recorder.filename, recorder.filename+".1")
+}
@@ -0,0 +1,111 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecorder(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+
+	// not t.TempDir, the recorder keeps writing after the test
+	dir, err := os.MkdirTemp("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stream.mjpg")
+
+	pubSub.RetryBase, pubSub.Jitter = 10*time.Millisecond, "none"
+
+	recorder, err := NewRecorder(pubSub, filename, 300)
+	if err != nil {
+		t.Fatalf("NewRecorder: %s", err)
+	}
+	recorder.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filename + ".1"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("recording not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	file, err := os.Open(filename + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	info, _ := file.Stat()
+	if info.Size() > 300 {
+		t.Errorf("rotated file is %d bytes, over the limit", info.Size())
+	}
+
+	frames := 0
+	mr := multipart.NewReader(file, recordBoundary)
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break // no closing boundary in a recording
+		}
+		if err != nil {
+			t.Fatalf("part %d: %s", frames, err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("part %d: %s", frames, err)
+		}
+		if err == nil && !isTestFrame(data) {
+			t.Errorf("part %d = %q, not a source frame", frames, data)
+		}
+		frames++
+	}
+	if frames == 0 {
+		t.Error("no frames recorded")
+	}
+}
+
+func TestRecordFileName(t *testing.T) {
+	tests := []struct {
+		filename, id, want string
+	}{
+		{"/var/rec/cams.mjpg", "front door", "/var/rec/cams-front_door.mjpg"},
+		{"rec", "/cam1", "rec-cam1"},
+	}
+
+	for _, tt := range tests {
+		if got := RecordFileName(tt.filename, tt.id); got != tt.want {
+			t.Errorf("RecordFileName(%q, %q) = %s, want %s", tt.filename, tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// keepStandby keeps the standby source connected, so that failing over
+// to it doesn't have to wait for a new connection. The frames are passed
+// to the loop, which drops them while the primary source is active.
+func (pubSub *PubSub) keepStandby() {
+	backoff, err := pubSub.newBackoff()
+	if err != nil {
+		pubSub.log.Error("standby disabled", "err", err)
+		return
+	}
+
+	for {
+		err := pubSub.standby.Connect()
+		if err != nil {
+			delay := backoff.Next()
+			pubSub.log.Warn("standby connect failed", "err", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		backoff.Reset()
+
+		frames := make(chan Frame)
+		go pubSub.standby.Start(frames)
+
+		atomic.StoreInt32(&pubSub.standbyUp, 1)
+		for frame := range frames {
+			pubSub.standbyChan <- frame
+		}
+		atomic.StoreInt32(&pubSub.standbyUp, 0)
+
+		pubSub.standbyDown <- struct{}{}
+	}
+}
+
+// failover switches the subscribers to the standby source when the
+// primary one fails. The primary is tried again once all the
+// subscribers leave or the standby source fails too.
+func (pubSub *PubSub) failover() bool {
+	if pubSub.standby == nil || len(pubSub.subscribers) == 0 {
+		return false
+	}
+
+	if atomic.LoadInt32(&pubSub.standbyUp) == 0 {
+		pubSub.log.Warn("standby not connected")
+		return false
+	}
+
+	pubSub.log.Warn("switching to standby source",
+		"standby", pubSub.standby.Source())
+	pubSub.onStandby = true
+
+	return true
+}
@@ -0,0 +1,57 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"sync/atomic"
+)
+
+// Stats holds the counters of a single stream. They are updated from the
+// pubsub loop and read by the metrics exporters, so all access must be
+// atomic.
+type Stats struct {
+	frames          int64
+	throttled       int64
+	bytes           int64
+	dropped         int64
+	subscribers     int64
+	massDisconnects int64
+}
+
+// StatsSnapshot is a consistent copy of the stream counters.
+type StatsSnapshot struct {
+	Frames          int64
+	Throttled       int64
+	Bytes           int64
+	Dropped         int64
+	Subscribers     int64
+	MassDisconnects int64
+}
+
+func (stats *Stats) Snapshot() StatsSnapshot {
+	return StatsSnapshot{
+		Frames:          atomic.LoadInt64(&stats.frames),
+		Throttled:       atomic.LoadInt64(&stats.throttled),
+		Bytes:           atomic.LoadInt64(&stats.bytes),
+		Dropped:         atomic.LoadInt64(&stats.dropped),
+		Subscribers:     atomic.LoadInt64(&stats.subscribers),
+		MassDisconnects: atomic.LoadInt64(&stats.massDisconnects),
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// StatsD periodically pushes the stream counters to a StatsD server
+// over UDP. Counters are sent as deltas since the previous push.
+type StatsD struct {
+	conn     net.Conn
+	prefix   string
+	interval time.Duration
+	pubSubs  []*PubSub
+	last     map[*PubSub]StatsSnapshot
+}
+
+func NewStatsD(addr, prefix string, interval time.Duration, pubSubs []*PubSub) (*StatsD, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval: %s", interval)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	statsd := new(StatsD)
+
+	statsd.conn = conn
+	statsd.prefix = strings.TrimSuffix(prefix, ".")
+	statsd.interval = interval
+	statsd.pubSubs = pubSubs
+	statsd.last = make(map[*PubSub]StatsSnapshot)
+
+	return statsd, nil
+}
+
+// statName turns a stream id into a single StatsD name component.
+func statName(id string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Trim(id, "/"))
+
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+func (statsd *StatsD) Start() {
+	logger.Info("sending metrics", "component", "statsd",
+		"addr", statsd.conn.RemoteAddr(), "interval", statsd.interval)
+	go statsd.loop()
+}
+
+func (statsd *StatsD) loop() {
+	ticker := time.NewTicker(statsd.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, pubSub := range statsd.pubSubs {
+			statsd.send(pubSub)
+		}
+	}
+}
+
+func (statsd *StatsD) send(pubSub *PubSub) {
+	cur := pubSub.stats.Snapshot()
+	last := statsd.last[pubSub]
+	statsd.last[pubSub] = cur
+
+	frames := cur.Frames - last.Frames
+	fps := float64(frames) / statsd.interval.Seconds()
+
+	name := statsd.prefix + "." + statName(pubSub.id)
+	if statsd.prefix == "" {
+		name = statName(pubSub.id)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s.frames:%d|c\n", name, frames)
+	fmt.Fprintf(&buf, "%s.bytes:%d|c\n", name, cur.Bytes-last.Bytes)
+	fmt.Fprintf(&buf, "%s.dropped:%d|c\n", name, cur.Dropped-last.Dropped)
+	fmt.Fprintf(&buf, "%s.subscribers:%d|g\n", name, cur.Subscribers)
+	fmt.Fprintf(&buf, "%s.fps:%.2f|g", name, fps)
+
+	_, err := statsd.conn.Write(buf.Bytes())
+	if err != nil {
+		logger.Warn("send failed", "component", "statsd", "stream", pubSub.id, "err", err)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// StreamStatus describes the current state of a stream for /status.
+type StreamStatus struct {
+	Stream        string   `json:"stream"`
+	Path          string   `json:"path"`
+	Source        string   `json:"source"`
+	Connected     bool     `json:"connected"`
+	OnStandby     bool     `json:"on_standby,omitempty"`
+	Subscribers   int      `json:"subscribers"`
+	Clients       []string `json:"clients,omitempty"`
+	UptimeSeconds float64  `json:"uptime_seconds"`
+	Frames        int64    `json:"frames"`
+	SourceFPS     float64  `json:"source_fps"`
+}
+
+// Status returns the state of the stream. The subscribers belong to the
+// loop goroutine, so the snapshot is taken there.
+func (pubSub *PubSub) Status() StreamStatus {
+	reply := make(chan StreamStatus, 1)
+	pubSub.statusChan <- reply
+	return <-reply
+}
+
+func (pubSub *PubSub) doStatus() StreamStatus {
+	status := StreamStatus{
+		Stream:      pubSub.id,
+		Path:        pubSub.path,
+		Source:      pubSub.chunker.Source(),
+		Connected:   pubSub.chunker.Connected(),
+		OnStandby:   pubSub.onStandby,
+		Subscribers: len(pubSub.subscribers),
+		Clients:     make([]string, 0, len(pubSub.subscribers)),
+		Frames:      pubSub.stats.Snapshot().Frames,
+		SourceFPS:   pubSub.chunker.FPS(),
+	}
+
+	for s := range pubSub.subscribers {
+		status.Clients = append(status.Clients, s.RemoteAddr)
+	}
+	sort.Strings(status.Clients)
+
+	if pubSub.pubChan != nil || pubSub.onStandby {
+		status.UptimeSeconds = time.Since(pubSub.startTime).Seconds()
+	}
+
+	return status
+}
+
+// StatusPage serves the state of all the streams as JSON. It has the
+// address and client checks of the streams. The client addresses are
+// only listed when the clients need credentials or a token, otherwise
+// anyone able to reach the proxy could see who is watching.
+type StatusPage struct {
+	pubSubs []*PubSub
+	access  *Access
+	started time.Time
+}
+
+type statusResponse struct {
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Streams       []StreamStatus `json:"streams"`
+}
+
+func NewStatusPage(pubSubs []*PubSub, access *Access) *StatusPage {
+	page := new(StatusPage)
+
+	page.pubSubs = pubSubs
+	page.access = access
+	page.started = time.Now()
+
+	return page
+}
+
+func (page *StatusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !page.access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !page.access.RequireAuth(w, r) {
+		return
+	}
+
+	resp := statusResponse{
+		UptimeSeconds: time.Since(page.started).Seconds(),
+		Streams:       make([]StreamStatus, 0, len(page.pubSubs)),
+	}
+	for _, pubSub := range page.pubSubs {
+		status := pubSub.Status()
+		if !page.access.AuthConfigured() {
+			status.Clients = nil
+		}
+		resp.Streams = append(resp.Streams, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(resp)
+	if err != nil {
+		logger.Debug("write failed", "component", "status", "err", err)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusPage(t *testing.T) {
+	source := liveSourceServer(t)
+	pubSub := newTestPubSub(t, source.URL)
+	sub := NewSubscriber("192.0.2.1:5000", 1)
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+
+	access := new(Access)
+	page := NewStatusPage([]*PubSub{pubSub}, access)
+
+	get := func(token, remoteAddr string) (int, statusResponse) {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		r.RemoteAddr = remoteAddr
+		if token != "" {
+			r.Header.Set("X-Auth-Token", token)
+		}
+		w := httptest.NewRecorder()
+		page.ServeHTTP(w, r)
+
+		var resp statusResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	// open without auth, but without the client addresses
+	code, resp := get("", "192.0.2.2:5000")
+	if code != http.StatusOK || len(resp.Streams) != 1 {
+		t.Fatalf("without auth: status = %d, streams = %+v", code, resp.Streams)
+	}
+	if status := resp.Streams[0]; status.Subscribers != 1 || status.Clients != nil {
+		t.Errorf("without auth: subscribers = %d, clients = %v, want 1 and none",
+			status.Subscribers, status.Clients)
+	}
+
+	access.Tokens = []string{"s3cr3t"}
+	if code, _ := get("", "192.0.2.2:5000"); code != http.StatusForbidden {
+		t.Errorf("without token: status = %d, want %d", code, http.StatusForbidden)
+	}
+	code, resp = get("s3cr3t", "192.0.2.2:5000")
+	if code != http.StatusOK || len(resp.Streams) != 1 {
+		t.Fatalf("with token: status = %d, streams = %+v", code, resp.Streams)
+	}
+	if clients := resp.Streams[0].Clients; len(clients) != 1 || clients[0] != "192.0.2.1:5000" {
+		t.Errorf("with token: clients = %v", clients)
+	}
+
+	access.Denied, _ = ParseCIDRs("192.0.2.2")
+	if code, _ := get("s3cr3t", "192.0.2.2:5000"); code != http.StatusForbidden {
+		t.Errorf("denied address: status = %d, want %d", code, http.StatusForbidden)
+	}
+}
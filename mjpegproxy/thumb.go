@@ -0,0 +1,192 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"sync"
+)
+
+const thumbQuality = 75
+
+type Thumbnailer struct {
+	pubSub *PubSub
+	width  int
+	mutex  sync.Mutex
+	hash   uint64
+	thumb  []byte
+}
+
+func NewThumbnailer(pubSub *PubSub, width int) *Thumbnailer {
+	thumbnailer := new(Thumbnailer)
+
+	thumbnailer.pubSub = pubSub
+	thumbnailer.width = width
+
+	return thumbnailer
+}
+
+func frameHash(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+// resizeImage scales the image down to the given width, keeping the
+// aspect ratio. Each target pixel is the average of the source pixels
+// it covers, which looks much better than sampling for large ratios.
+func resizeImage(src image.Image, width int) image.Image {
+	b := src.Bounds()
+	if b.Dx() <= width {
+		return src
+	}
+
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+// thumbnail returns the cached thumbnail, regenerating it only when
+// the source frame has changed since the last request.
+func (thumbnailer *Thumbnailer) thumbnail(data []byte) ([]byte, error) {
+	hash := frameHash(data)
+
+	thumbnailer.mutex.Lock()
+	defer thumbnailer.mutex.Unlock()
+
+	if thumbnailer.thumb != nil && thumbnailer.hash == hash {
+		return thumbnailer.thumb, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, resizeImage(img, thumbnailer.width),
+		&jpeg.Options{Quality: thumbQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnailer.hash = hash
+	thumbnailer.thumb = buf.Bytes()
+
+	return thumbnailer.thumb, nil
+}
+
+func (thumbnailer *Thumbnailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if thumbnailer.pubSub.Access.HandleCORS(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", thumbnailer.pubSub.Access.AllowedMethods())
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !thumbnailer.pubSub.Access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !thumbnailer.pubSub.Access.RequireAuth(w, r) {
+		return
+	}
+
+	if !thumbnailer.pubSub.Access.RefererAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	log := thumbnailer.pubSub.serverLog
+	frame, err := thumbnailer.pubSub.nextFrame(r, thumbnailer.pubSub.SnapshotTimeout)
+	if err == errFrameTimeout {
+		log.Warn("thumbnail frame timeout", "timeout", thumbnailer.pubSub.SnapshotTimeout)
+		http.Error(w, "Frame timeout", http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		serveFailure(w, log.With("client", thumbnailer.pubSub.Access.ClientAddress(r)), err)
+		return
+	}
+
+	thumb, err := thumbnailer.thumbnail(frame.Data)
+	frame.Release()
+	if err != nil {
+		log.Error("thumbnail create failed", "err", err)
+		http.Error(w, "Thumbnail failed", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "image/jpeg")
+	header.Set("Content-Length", fmt.Sprintf("%d", len(thumb)))
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = w.Write(thumb)
+	if err != nil {
+		log.Debug("thumbnail write failed", "err", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	// left half red, right half blue
+	src := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 2 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			src.SetRGBA(x, y, c)
+		}
+	}
+
+	dst := resizeImage(src, 2)
+	if b := dst.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("resized to %dx%d, want 2x1", b.Dx(), b.Dy())
+	}
+	for x, want := range []color.RGBA{{R: 255, A: 255}, {B: 255, A: 255}} {
+		if got := color.RGBAModel.Convert(dst.At(x, 0)); got != want {
+			t.Errorf("pixel %d = %v, want %v", x, got, want)
+		}
+	}
+
+	// pixels covering several source ones are averaged
+	if got := color.RGBAModel.Convert(resizeImage(src, 1).At(0, 0)); got != (color.RGBA{R: 127, B: 127, A: 255}) {
+		t.Errorf("averaged pixel = %v, want half red and half blue", got)
+	}
+
+	if dst := resizeImage(src, 8); dst != image.Image(src) {
+		t.Error("an image narrower than the thumbnail was scaled")
+	}
+}
+
+func testJPEG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestThumbnailCache(t *testing.T) {
+	thumbnailer := NewThumbnailer(nil, 160)
+	frame := testJPEG(t, 320, 240, color.White)
+
+	thumb, err := thumbnailer.thumbnail(frame)
+	if err != nil {
+		t.Fatalf("thumbnail: %s", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatalf("thumbnail is not a JPEG image: %s", err)
+	}
+	if b := img.Bounds(); b.Dx() != 160 || b.Dy() != 120 {
+		t.Errorf("thumbnail is %dx%d, want 160x120", b.Dx(), b.Dy())
+	}
+
+	again, err := thumbnailer.thumbnail(append([]byte(nil), frame...))
+	if err != nil {
+		t.Fatalf("thumbnail: %s", err)
+	}
+	if &again[0] != &thumb[0] {
+		t.Error("thumbnail made again for the same frame")
+	}
+
+	other, err := thumbnailer.thumbnail(testJPEG(t, 320, 240, color.Black))
+	if err != nil {
+		t.Fatalf("thumbnail: %s", err)
+	}
+	if bytes.Equal(other, thumb) {
+		t.Error("thumbnail not made again for a new frame")
+	}
+
+	if _, err := thumbnailer.thumbnail([]byte("not a jpeg")); err == nil {
+		t.Error("thumbnail of a broken frame succeeded")
+	}
+}
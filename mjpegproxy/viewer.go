@@ -0,0 +1,122 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var viewerTemplate = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Stream}}{{.Stream.Name}}{{else}}mjpeg-proxy{{end}}</title>
+<style>
+body { margin: 0; background: #111; color: #ddd; font-family: sans-serif; }
+img { display: block; max-width: 100%; margin: 0 auto; }
+ul { padding: 1em 2em; }
+a { color: #8cf; }
+</style>
+</head>
+<body>
+{{- if .Stream}}
+<img src="{{.Stream.Path}}{{with .Token}}?token={{.}}{{end}}" alt="{{.Stream.Name}}">
+{{- if .Streams}}
+<ul><li><a href="?{{with .Token}}token={{.}}{{end}}">All streams</a></li></ul>
+{{- end}}
+{{- else}}
+<ul>
+{{- range .Streams}}
+<li><a href="?stream={{.Path}}{{with $.Token}}&amp;token={{.}}{{end}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+{{- end}}
+</body>
+</html>
+`))
+
+type viewerStream struct {
+	Name string
+	Path string
+}
+
+type viewerPage struct {
+	Stream  *viewerStream
+	Streams []viewerStream
+	Token   string // passed on to the stream when the page was opened with it
+}
+
+// Viewer serves a simple HTML page showing a stream, or an index of all
+// the streams when there are several of them.
+type Viewer struct {
+	streams []viewerStream
+	access  *Access
+}
+
+func NewViewer(pubSubs []*PubSub, access *Access) *Viewer {
+	viewer := new(Viewer)
+
+	viewer.access = access
+
+	for _, pubSub := range pubSubs {
+		viewer.streams = append(viewer.streams, viewerStream{Name: pubSub.id, Path: pubSub.path})
+	}
+
+	return viewer
+}
+
+func (viewer *Viewer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !viewer.access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !viewer.access.RequireAuth(w, r) {
+		return
+	}
+
+	var page viewerPage
+	if viewer.access.AuthConfigured() {
+		// the <img> request can't send the X-Auth-Token header
+		token := requestToken(r)
+		if token != "" && viewer.access.tokenAuthorized(token) {
+			page.Token = token
+		}
+	}
+	if len(viewer.streams) == 1 {
+		page.Stream = &viewer.streams[0]
+	} else {
+		path := r.URL.Query().Get("stream")
+		for i := range viewer.streams {
+			if viewer.streams[i].Path == path {
+				page.Stream = &viewer.streams[i]
+			}
+		}
+		page.Streams = viewer.streams
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := viewerTemplate.Execute(w, page)
+	if err != nil {
+		logger.Debug("write failed", "component", "viewer", "err", err)
+	}
+}
@@ -0,0 +1,67 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestViewerToken(t *testing.T) {
+	access := &Access{User: "viewer", Pass: "secret", Tokens: []string{"s3cr3t"}}
+	viewer := NewViewer([]*PubSub{NewPubSub("cam", "/cam", nil, nil)}, access)
+
+	tests := []struct {
+		name string
+		auth func(r *http.Request)
+		want string
+	}{
+		{"query", func(r *http.Request) { r.URL.RawQuery = "token=s3cr3t" }, `src="/cam?token=s3cr3t"`},
+		{"header", func(r *http.Request) { r.Header.Set("X-Auth-Token", "s3cr3t") }, `src="/cam?token=s3cr3t"`},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("viewer", "secret") }, `src="/cam"`},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/viewer", nil)
+		tt.auth(r)
+		w := httptest.NewRecorder()
+		viewer.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("%s: got %d %q, want %s", tt.name, w.Code, w.Body.String(), tt.want)
+		}
+	}
+}
+
+func TestViewerIndexToken(t *testing.T) {
+	access := &Access{Tokens: []string{"s3cr3t"}}
+	viewer := NewViewer([]*PubSub{
+		NewPubSub("front", "/front", nil, nil),
+		NewPubSub("back", "/back", nil, nil),
+	}, access)
+
+	w := httptest.NewRecorder()
+	viewer.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/viewer?token=s3cr3t", nil))
+	if n := strings.Count(w.Body.String(), "&amp;token=s3cr3t"); n != 2 {
+		t.Errorf("%d stream links carry the token, want 2: %s", n, w.Body.String())
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+)
+
+type webhookEvent struct {
+	Stream string    `json:"stream"`
+	Name   string    `json:"name"`
+	Event  string    `json:"event"`
+	Time   time.Time `json:"time"`
+}
+
+// Webhook posts a JSON message to the URL when a stream goes down
+// for good, after the reconnect attempts, and when it is back up. The
+// posts are queued and sent from a goroutine of their own, so a slow or
+// unreachable webhook never holds up the streams.
+type Webhook struct {
+	url    string
+	client *http.Client
+	events chan webhookEvent
+	log    *slog.Logger
+}
+
+func NewWebhook(url string) *Webhook {
+	webhook := new(Webhook)
+
+	webhook.url = url
+	webhook.client = &http.Client{Timeout: webhookTimeout}
+	webhook.events = make(chan webhookEvent, 64)
+	webhook.log = logger.With("component", "webhook")
+
+	return webhook
+}
+
+func (webhook *Webhook) Start() {
+	go webhook.run()
+}
+
+// Watch reports the up and down changes of the chunker of a stream. An
+// OnStateChange hook already set on the chunker is still called.
+func (webhook *Webhook) Watch(chunker *Chunker, path string) {
+	var down int32
+	prev := chunker.OnStateChange
+	chunker.OnStateChange = func(state string) {
+		if prev != nil {
+			prev(state)
+		}
+
+		switch state {
+		case StateFailed:
+			if atomic.CompareAndSwapInt32(&down, 0, 1) {
+				webhook.notify(path, chunker.id, "down")
+			}
+		case StateConnected:
+			if atomic.CompareAndSwapInt32(&down, 1, 0) {
+				webhook.notify(path, chunker.id, "up")
+			}
+		}
+	}
+}
+
+func (webhook *Webhook) notify(path, id, event string) {
+	select {
+	case webhook.events <- webhookEvent{path, id, event, time.Now().UTC()}:
+	default:
+		webhook.log.Warn("webhook queue full, dropping event", "stream", id, "event", event)
+	}
+}
+
+func (webhook *Webhook) run() {
+	for event := range webhook.events {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			webhook.log.Error("webhook encoding failed", "err", err)
+			continue
+		}
+
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			err = webhook.post(payload)
+			if err == nil {
+				webhook.log.Debug("webhook sent", "stream", event.Name, "event", event.Event)
+				break
+			}
+			webhook.log.Warn("webhook failed", "stream", event.Name, "event", event.Event,
+				"attempt", attempt, "err", err)
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+	}
+}
+
+func (webhook *Webhook) post(payload []byte) error {
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
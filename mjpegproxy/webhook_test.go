@@ -0,0 +1,85 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	events := make(chan webhookEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook payload: %s", err)
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(server.URL)
+	webhook.Start()
+
+	chunker := newTestChunker(t, "http://camera.invalid/mjpg")
+	webhook.Watch(chunker, "/cam1")
+
+	for _, state := range []string{StateConnected, StateFailed, StateReconnecting, StateFailed, StateConnected, StateConnected} {
+		chunker.OnStateChange(state)
+	}
+
+	for _, want := range []string{"down", "up"} {
+		select {
+		case event := <-events:
+			if event.Event != want || event.Stream != "/cam1" || event.Time.IsZero() {
+				t.Errorf("got %+v, want %s", event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want)
+		}
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookKeepsHook(t *testing.T) {
+	webhook := NewWebhook("http://hooks.invalid/")
+
+	chunker := newTestChunker(t, "http://camera.invalid/mjpg")
+	var states []string
+	chunker.OnStateChange = func(state string) {
+		states = append(states, state)
+	}
+	webhook.Watch(chunker, "/cam1")
+
+	chunker.OnStateChange(StateFailed)
+	chunker.OnStateChange(StateConnected)
+	if got := strings.Join(states, " "); got != "failed connected" {
+		t.Errorf("earlier hook got %q, want both states", got)
+	}
+}
@@ -0,0 +1,322 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The WebSocket output sends every frame as one binary message holding
+// just the JPEG image. Only the small part of RFC 6455 needed for that
+// is implemented here: the handshake, unmasked frames from the server
+// and reading the client frames for close and ping.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xa
+)
+
+// close status codes
+const (
+	wsNormalClosure = 1000
+	wsGoingAway     = 1001
+)
+
+// wsWriteTimeout drops clients that stop reading, the HTTP server
+// timeouts no longer apply once the connection is taken over.
+const wsWriteTimeout = 30 * time.Second
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, s := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeWebSocket writes a single unfragmented frame.
+func writeWebSocket(w io.Writer, opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	_, err := w.Write(header)
+	if err == nil {
+		_, err = w.Write(payload)
+	}
+	return err
+}
+
+// readWebSocket reads the client frames, answering pings through the
+// pong channel, until the client closes the connection.
+func readWebSocket(r *bufio.Reader, pongs chan<- []byte) error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := int64(header[1] & 0x7f)
+
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(ext[:]) & (1<<63 - 1))
+		}
+
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(r, mask[:]); err != nil {
+				return err
+			}
+		}
+
+		// the clients have nothing to say, skip their messages
+		if opcode < wsClose {
+			if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if length > 125 {
+			return errors.New("control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			return io.EOF
+		case wsPing:
+			select {
+			case pongs <- payload:
+			default: // a pong is already pending
+			}
+		}
+	}
+}
+
+// ServeWebSocket sends the frames of the stream to a WebSocket client,
+// one binary message per JPEG image.
+func (pubSub *PubSub) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, fmt.Sprintf("HTTP method %s not supported", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !pubSub.Access.AddressAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !pubSub.Access.RequireAuth(w, r) {
+		return
+	}
+
+	// browsers always send the Origin of the page opening the socket
+	if !pubSub.Access.RefererAllowed(r) || !pubSub.Access.originAllowed(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusBadRequest)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid query", http.StatusBadRequest)
+		return
+	}
+	interval := sendInterval(r.FormValue("fps"), pubSub.MaxFPS)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		pubSub.serverLog.Error("client could not be hijacked", "client", r.RemoteAddr)
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// limit connections coming from a single client
+	client := pubSub.Access.ClientAddress(r)
+	log := pubSub.serverLog.With("client", client)
+	if pubSub.MaxClientsPerIP > 0 {
+		ip := clientIP(client)
+		if !pubSub.acquireClient(ip) {
+			log.Info("client over connection limit", "limit", pubSub.MaxClientsPerIP)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer pubSub.releaseClient(ip)
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Error("websocket hijack failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{}) // left over from the server read timeout
+
+	sub := NewSubscriber(client, pubSub.ClientBuffer)
+	sub.interval = interval
+	out := bufio.NewWriter(countingWriter{pubSub.limitWriter(conn, r.Context()), &sub.Bytes})
+
+	fmt.Fprintf(out, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		websocketAccept(key))
+	if err := out.Flush(); err != nil {
+		log.Debug("websocket handshake failed", "err", err)
+		return
+	}
+
+	pubSub.Subscribe(sub)
+	defer pubSub.Unsubscribe(sub)
+	defer func() {
+		log.Info("session ended", "path", r.URL.Path, "websocket", true,
+			"frames", atomic.LoadInt64(&sub.Frames), "bytes", atomic.LoadInt64(&sub.Bytes),
+			"duration", time.Since(sub.Started).Round(time.Millisecond))
+	}()
+
+	pongs := make(chan []byte, 1)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- readWebSocket(rw.Reader, pongs)
+	}()
+
+	var sessionEnd <-chan time.Time
+	if pubSub.MaxSession > 0 {
+		timer := time.NewTimer(pubSub.MaxSession)
+		defer timer.Stop()
+		sessionEnd = timer.C
+	}
+
+	status := wsNormalClosure
+LOOP:
+	for {
+		var opcode byte
+		var payload []byte
+		var frame Frame
+		var ok bool
+
+		select {
+		case frame, ok = <-sub.ChunkChannel:
+			if !ok {
+				status = wsGoingAway
+				break LOOP
+			}
+			opcode, payload = wsBinary, frame.Data
+		case ping := <-pongs:
+			opcode, payload = wsPong, ping
+		case err := <-closed:
+			if err != io.EOF {
+				log.Debug("websocket read failed", "err", err)
+			}
+			break LOOP
+		case <-sessionEnd:
+			log.Info("session time limit reached", "limit", pubSub.MaxSession)
+			break LOOP
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		err := writeWebSocket(out, opcode, payload)
+		if err == nil {
+			err = out.Flush()
+		}
+		frame.Release()
+		if err != nil {
+			log.Debug("websocket write failed", "err", err)
+			sub.writeFailed = true
+			return
+		}
+		if opcode == wsBinary {
+			atomic.AddInt64(&sub.Frames, 1)
+		}
+	}
+
+	reason := make([]byte, 2)
+	binary.BigEndian.PutUint16(reason, uint16(status))
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if writeWebSocket(out, wsClose, reason) == nil {
+		out.Flush()
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * mjpeg-proxy -- Republish a MJPEG HTTP image stream using a server in Go
+ *
+ * Copyright (C) 2015-2020, Valentin Vidic
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package mjpegproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// example from RFC 6455
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("websocketAccept = %s", got)
+	}
+}
+
+// readServerFrame reads an unmasked frame sent by the server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("read frame: %s", err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frame is masked")
+	}
+
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read payload: %s", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// writeClientFrame writes a masked frame like a browser would.
+func writeClientFrame(w io.Writer, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	w.Write(frame)
+}
+
+func TestServeWebSocket(t *testing.T) {
+	source := liveSourceServer(t)
+	server := httptest.NewServer(http.HandlerFunc(newTestPubSub(t, source.URL).ServeWebSocket))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: test\r\n"+
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("handshake: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake: %s %v", resp.Status, resp.Header)
+	}
+
+	for i := 0; i < 2; i++ {
+		opcode, payload := readServerFrame(t, r)
+		if opcode != wsBinary || !isTestFrame(payload) {
+			t.Fatalf("message %d: opcode %d payload %q", i, opcode, payload)
+		}
+	}
+
+	writeClientFrame(conn, wsPing, []byte("hello"))
+	for {
+		opcode, payload := readServerFrame(t, r)
+		if opcode == wsBinary {
+			continue
+		}
+		if opcode != wsPong || string(payload) != "hello" {
+			t.Fatalf("got opcode %d payload %q, want pong", opcode, payload)
+		}
+		break
+	}
+
+	writeClientFrame(conn, wsClose, []byte{0x03, 0xe8})
+	for {
+		opcode, _ := readServerFrame(t, r)
+		if opcode == wsClose {
+			break
+		}
+	}
+}
+
+func TestServeWebSocketNoUpgrade(t *testing.T) {
+	pubSub := NewPubSub("test", "/test", nil, nil)
+
+	w := httptest.NewRecorder()
+	pubSub.ServeWebSocket(w, httptest.NewRequest(http.MethodGet, "/test/ws", nil))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUpgradeRequired)
+	}
+}
+
+func TestServeWebSocketOrigin(t *testing.T) {
+	pubSub := NewPubSub("test", "/test", nil, nil)
+	pubSub.Access = &Access{CORSOrigins: []string{"https://app.example.com"}}
+
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusUpgradeRequired},
+		{"http://example.com", http.StatusUpgradeRequired}, // the proxy itself
+		{"https://app.example.com", http.StatusUpgradeRequired},
+		{"https://evil.example.net", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/test/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		pubSub.ServeWebSocket(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Origin %q: status = %d, want %d", tt.origin, w.Code, tt.want)
+		}
+	}
+}